@@ -3,13 +3,19 @@ package cmd
 import (
 	"fmt"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 
 	"github.com/logston/aws-aliased-profiles/common"
 	"github.com/logston/aws-aliased-profiles/defaults"
+	"github.com/logston/aws-aliased-profiles/diff"
 	"github.com/logston/aws-aliased-profiles/fetch"
+	"github.com/logston/aws-aliased-profiles/inventory"
+	"github.com/logston/aws-aliased-profiles/list"
 	"github.com/logston/aws-aliased-profiles/upsert"
+	"github.com/logston/aws-aliased-profiles/whois"
 )
 
 var rootCmd = &cobra.Command{
@@ -21,12 +27,18 @@ var initCmd = &cobra.Command{
 	Use:   "init",
 	Short: "init ~/.aws/aliased-profiles/config.tpml",
 	Run: func(cmd *cobra.Command, args []string) {
+		if initSSO {
+			defaults.InitSSOProfileTemplate()
+			return
+		}
 		defaults.InitProfileTemplate()
 	},
 }
 
+var initSSO bool
+
 var fetchCmd = &cobra.Command{
-	Use:   "fetch <profile> <accountRole>",
+	Use:   "fetch [<profile> <accountRole>]",
 	Short: "fetch data from organizational unit",
 	Long: `fetch data from AWS
 
@@ -37,27 +49,384 @@ Fetch data for each account using the <profile> profile to assume the
 This profile will also be used to list all the accounts in an organizational unit.
 
 <accountRole> is the role name to assume in each account such that alias
-information can be gathered.
+information can be gathered. Use --fallback-role, which may be repeated, to
+try other roles in order in accounts where <accountRole> cannot be assumed or
+may not read the alias. The role that worked is recorded for each account.
+
+Without <profile> and <accountRole>, every organization in
+~/.aws/aliased-profiles/settings.json is fetched into its own state file
+using its own profile and role. Use --org to only fetch some of them.
+
+Use --sso-session, or --sso-start-url and --sso-region, to fetch the accounts,
+and the roles assigned in each, that you may access through IAM Identity
+Center instead, using the token cached by aws sso login. No access to AWS
+Organizations is needed, but the accounts have no aliases or tags. Run init
+--sso for a template that adds an SSO profile per account and role.
+
+Use --source-file to fetch the accounts listed in a JSON file, shaped like
+the state file, instead of from AWS. This is handy for trying templates and
+upsert without access to AWS.
+
+Use --external-id, --session-name and --duration-seconds to control how the
+fetch role is assumed. The session name is a template in which {{user}},
+{{host}} and {{account}} expand to the local user, the local host and the
+account the role is assumed in. Use --mfa-command to run a command that
+prints the MFA token for <profile>, so that fetch can run unattended. Each of
+these may also be set under AssumeRole in the settings file.
+
+Use --discover-role, which may be repeated, to record which of the given
+roles exist in each account and may be assumed from <profile>. Use
+--list-roles to also list the roles of each account with the fetch role,
+keeping those under --role-path-prefix, named with --role-name-prefix and
+carrying every --role-tag, and record those that may be assumed. The roles
+are available to templates as .Roles. Discovery may also be configured under
+RoleDiscovery in the settings file.
+
+Use --endpoint-url to send every Organizations, STS and IAM request to
+another endpoint, e.g. LocalStack or the fake server in fetch/fetchtest.
+
+Use --ou to only fetch the accounts beneath one or more roots or
+organizational units, and --exclude-ou to skip the accounts beneath others.
+Both flags take IDs (e.g. ou-abcd-12345678) and may be repeated.
+
+Use --incremental to reuse the aliases and tags in the existing state for
+accounts whose data is younger than --alias-ttl and --tags-ttl. Only new
+accounts and stale attributes are fetched from AWS.
+
+Accounts are listed, and their tags and aliases fetched, at the same time:
+each page of accounts is handed to the tags and alias workers as soon as it
+is listed. Use --tags-concurrency and --alias-concurrency to size each pool
+of workers.
+
+Progress is checkpointed to ~/.aws/aliased-profiles/progress.json as accounts
+complete. If a fetch is interrupted, e.g. with Ctrl-C, run it again with
+--resume to skip the tags and aliases it already fetched.
+
+Calls to each AWS API are paced by a limiter which allows at most
+--concurrency calls in flight and --rps requests per second. Both back off
+when AWS throttles requests, and throttled or transient failures are retried
+with jittered exponential backoff.
+
+An account whose alias or tags cannot be fetched does not stop the fetch.
+The outcome for each account is recorded in the state and a summary is
+printed at the end. Accounts beneath a root or organizational unit whose tags
+cannot be fetched are missing the tags they would inherit and count as failed
+too. Use --fail-on-errors to exit non-zero if any account failed, e.g. in CI.
 `,
-	Args: cobra.ExactArgs(2),
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 0 && len(args) != 2 {
+			return fmt.Errorf("accepts 0 or 2 arg(s), received %d", len(args))
+		}
+		if len(args) != 0 && len(fetchOrgs) != 0 {
+			return fmt.Errorf("--org cannot be used with <profile> and <accountRole>")
+		}
+		if fetchSourceFile != "" && (len(args) != 0 || len(fetchOrgs) != 0) {
+			return fmt.Errorf("--source-file cannot be used with <profile> and <accountRole> or --org")
+		}
+		if fetchOpts.SSO.Enabled() && (len(args) != 0 || len(fetchOrgs) != 0 || fetchSourceFile != "") {
+			return fmt.Errorf("--sso-session and --sso-start-url cannot be used with <profile> and <accountRole>, --org or --source-file")
+		}
+		return nil
+	},
 	Run: func(cmd *cobra.Command, args []string) {
-		fetch.AliasToAccountMap(common.NewCtx(), args[0], args[1])
+		// Exit only once the lock is released, as os.Exit skips deferred
+		// calls.
+		if failed := fetchAccounts(args); failed > 0 && fetchFailOnErrors {
+			fmt.Fprintf(os.Stderr, "Failed to fetch %d accounts\n", failed)
+			os.Exit(1)
+		}
 	},
 }
 
+// fetchAccounts fetches the accounts as the arguments and flags of fetch ask,
+// holding the lock, and returns the number of accounts that failed.
+func fetchAccounts(args []string) (failed int) {
+	defer common.Lock()()
+
+	if fetchSourceFile != "" {
+		src, err := fetch.NewFileSource(fetchSourceFile)
+		common.ExitWithError(err)
+		failed = fetch.Fetch(common.NewCtx(), src, fetchOpts)
+	} else if fetchOpts.SSO.Enabled() {
+		failed = fetch.SSO(common.NewCtx(), fetchOpts)
+	} else if len(args) == 0 {
+		failed = fetch.Organizations(common.NewCtx(), fetchOpts, common.ReadSettings(), fetchOrgs)
+	} else {
+		fetchOpts.MasterProfile = args[0]
+		fallbacks := fetchFallbackRoles
+		if len(fallbacks) == 0 {
+			fallbacks = common.ReadSettings().FallbackRoles
+		}
+		fetchOpts.AccountRoles = append([]string{args[1]}, fallbacks...)
+		fetchOpts.AssumeRole = fetchOpts.AssumeRole.Or(common.ReadSettings().AssumeRole)
+		fetchOpts.RoleDiscovery = fetchOpts.RoleDiscovery.Or(common.ReadSettings().RoleDiscovery)
+		failed = fetch.AliasToAccountMap(common.NewCtx(), fetchOpts)
+	}
+
+	return
+}
+
+var (
+	fetchOpts          fetch.Options
+	fetchOrgs          []string
+	fetchFallbackRoles []string
+	fetchFailOnErrors  bool
+	fetchSourceFile    string
+)
+
 var upsertCmd = &cobra.Command{
 	Use:   "upsert",
 	Short: "upsert ~/.aws/config with data from organizational unit",
 	Run: func(cmd *cobra.Command, args []string) {
+		defer common.Lock()()
+
 		upsert.AWSConfig()
 	},
 }
 
+var diffCmd = &cobra.Command{
+	Use:   "diff [<snapshot> [<snapshot>]]",
+	Short: "show how the organization changed between fetches",
+	Long: `show how the organization changed between fetches
+
+Each time fetch replaces a state file, the previous one is kept as a snapshot
+in ~/.aws/aliased-profiles/history, named after the time it was written.
+The most recent snapshots, 10 unless HistorySize is set in the settings file,
+are kept for each organization. Use --list to list them.
+
+Without arguments, the latest snapshot is compared with the current state,
+showing what changed in the last fetch. With one <snapshot>, that snapshot is
+compared with the current state, and with two, the first is compared with the
+second. A <snapshot> is the name of a snapshot, with or without .json, or the
+path of any state file.
+
+Accounts added, removed, suspended, re-aliased and renamed, and accounts whose
+status or tags changed, are listed. Use --json for output that is easier to
+process and --exit-code to exit with 1 when anything changed, e.g. in CI.
+
+Use --org to compare the snapshots of an organization in the settings file.
+`,
+	Args: cobra.MaximumNArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		if diffList {
+			for _, s := range common.ListSnapshots(diffOrg) {
+				fmt.Printf("%s  %s\n", s.Time.Local().Format(time.RFC1123), s.Name)
+			}
+			return
+		}
+
+		d, err := diff.States(diffOrg, args)
+		common.ExitWithError(err)
+
+		if diffJSON {
+			diff.PrintJSON(os.Stdout, d)
+		} else {
+			diff.Print(os.Stdout, d)
+		}
+
+		if diffExitCode && !d.Empty() {
+			os.Exit(1)
+		}
+	},
+}
+
+var (
+	diffOrg      string
+	diffJSON     bool
+	diffList     bool
+	diffExitCode bool
+)
+
+var importCmd = &cobra.Command{
+	Use:   "import <file>",
+	Short: "import accounts from a CSV, YAML or JSON inventory file",
+	Long: `import accounts from a CSV, YAML or JSON inventory file
+
+Import the accounts listed in <file> into the state, for accounts that cannot
+be fetched, e.g. those of partner organizations, or to hand out an inventory
+to machines without access to AWS. upsert then treats them like fetched ones.
+
+A CSV file needs a header naming its columns. The id, alias, name, email and
+status columns fill those fields and every other column, optionally prefixed
+with tag:, is a tag:
+
+    id,alias,name,status,environment
+    123456789012,partner-prod,Partner Production,ACTIVE,production
+
+A YAML or JSON file is a list of accounts with id, alias, name, email, status
+and a map of tags:
+
+    - id: "123456789012"
+      alias: partner-prod
+      tags:
+        environment: production
+
+The format is taken from the extension of <file> unless --format is given.
+Account IDs must be 12 digits, and IDs and aliases must not repeat. Status is
+one of ACTIVE, the default, SUSPENDED or PENDING_CLOSURE.
+
+Use --org to import into the state of an organization in the settings file
+with "Import": true, which fetch skips, so that fetching and importing do not
+replace each other's accounts:
+
+    {"Organizations": [{"Name": "partner", "Import": true}]}
+
+The accounts replace the state of the organization, or are merged into it
+with --merge, in which case the alias, name, email and status given for an
+account already in the state replace its own and its tags are added to its
+own. A state written by fetch is only replaced with --force.
+`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		defer common.Lock()()
+
+		inventory.Import(args[0], importOpts)
+	},
+}
+
+var importOpts inventory.Options
+
+var listCmd = &cobra.Command{
+	Use:   "list",
+	Short: "list the accounts in the state",
+	Long: `list the accounts in the state
+
+List the accounts in the state of every organization as a table, or as CSV,
+JSON, YAML or Markdown with --output.
+
+Use --org, --status, --ou, --tag, --has-alias and --alias-glob to only list
+some accounts. --tag takes key or key=value and matches the effective tags of
+each account, including those inherited from its organizational units. Each
+filter may be repeated; accounts must pass every filter and match any value
+of a repeated --org, --status or --ou but every --tag.
+
+Use --query to filter with a JMESPath expression evaluated against the
+accounts, in the shape of the state file, e.g. "[?length(Roles) > ` + "`1`" + `]".
+When the expression yields accounts they are listed as usual, and otherwise
+its result, e.g. of "[].Alias", is printed as JSON, or YAML with --output
+yaml.
+
+Use --columns to choose the columns printed, by name or as tag:<key> for the
+value of an effective tag, and --sort to sort by columns, each descending when
+prefixed with -, e.g. --sort -status,alias. Both take a comma separated list
+or may be repeated. The columns are:
+
+`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		common.ExitWithError(list.List(os.Stdout, listOpts))
+	},
+}
+
+var listOpts list.Options
+
+var whoisCmd = &cobra.Command{
+	Use:   "whois [<query>...]",
+	Short: "look up accounts in the state by ID, alias, name or ARN",
+	Long: `look up accounts in the state by ID, alias, name or ARN
+
+Look up each <query> in the state of every organization, without calling
+AWS, and print everything known about the matching accounts: status, tags,
+OUs and the profiles the template generates for them, with the overrides
+file applied.
+
+A <query> is an account ID, an ARN containing one, e.g. of a role or of an
+account in an organization, or an account alias, account name or profile
+name, ignoring case. Without any <query>, or with -, queries are read from
+stdin, one per line:
+
+    aws-aliased-profiles whois 123456789012 data-prod
+    cut -d, -f1 findings.csv | aws-aliased-profiles whois --json
+
+Use --json for output that is easier to process. whois exits with 1 if any
+query matched no account.
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		queries := args
+		if len(args) == 0 || (len(args) == 1 && args[0] == "-") {
+			var err error
+			queries, err = whois.ReadQueries(os.Stdin)
+			common.ExitWithError(err)
+		}
+
+		unmatched, err := whois.Whois(os.Stdout, queries, whoisJSON)
+		common.ExitWithError(err)
+
+		if len(unmatched) != 0 {
+			os.Exit(1)
+		}
+	},
+}
+
+var whoisJSON bool
+
+func init() {
+	initCmd.Flags().BoolVar(&initSSO, "sso", false, "place the template for accounts fetched through IAM Identity Center")
+
+	fetchCmd.Flags().StringArrayVar(&fetchOrgs, "org", nil, "only fetch this organization from the settings file")
+	fetchCmd.Flags().StringArrayVar(&fetchFallbackRoles, "fallback-role", nil, "role to try, in order, when <accountRole> cannot be assumed or may not read the alias")
+	fetchCmd.Flags().StringVar(&fetchOpts.AssumeRole.ExternalId, "external-id", "", "external ID to pass when assuming the fetch role")
+	fetchCmd.Flags().StringVar(&fetchOpts.AssumeRole.SessionName, "session-name", "", "role session name template, e.g. 'aliased-profiles-{{user}}'")
+	fetchCmd.Flags().IntVar(&fetchOpts.AssumeRole.DurationSeconds, "duration-seconds", 0, "how long assumed role credentials are valid for")
+	fetchCmd.Flags().StringVar(&fetchOpts.AssumeRole.MFACommand, "mfa-command", "", "command that prints the MFA token for <profile> instead of prompting on stdin")
+	fetchCmd.Flags().StringArrayVar(&fetchOpts.RoleDiscovery.Candidates, "discover-role", nil, "record whether this role exists and may be assumed in each account")
+	fetchCmd.Flags().BoolVar(&fetchOpts.RoleDiscovery.List, "list-roles", false, "list the roles of each account and record those that may be assumed")
+	fetchCmd.Flags().StringVar(&fetchOpts.RoleDiscovery.PathPrefix, "role-path-prefix", "", "only keep listed roles whose path starts with this, e.g. /team/")
+	fetchCmd.Flags().StringVar(&fetchOpts.RoleDiscovery.NamePrefix, "role-name-prefix", "", "only keep listed roles whose name starts with this")
+	fetchCmd.Flags().StringArrayVar(&fetchOpts.RoleDiscovery.Tags, "role-tag", nil, "only keep listed roles with this tag, given as key or key=value")
+	fetchCmd.Flags().StringVar(&fetchOpts.EndpointURL, "endpoint-url", "", "send AWS requests to this URL instead, e.g. http://localhost:4566")
+	fetchCmd.Flags().StringArrayVar(&fetchOpts.OUs, "ou", nil, "only fetch accounts beneath this root or organizational unit ID")
+	fetchCmd.Flags().StringArrayVar(&fetchOpts.ExcludeOUs, "exclude-ou", nil, "skip accounts beneath this root or organizational unit ID")
+	fetchCmd.Flags().BoolVar(&fetchOpts.Incremental, "incremental", false, "reuse fresh aliases and tags from the existing state")
+	fetchCmd.Flags().DurationVar(&fetchOpts.AliasTTL, "alias-ttl", 7*24*time.Hour, "how long a fetched alias stays fresh with --incremental")
+	fetchCmd.Flags().DurationVar(&fetchOpts.TagsTTL, "tags-ttl", 24*time.Hour, "how long fetched tags stay fresh with --incremental")
+	fetchCmd.Flags().BoolVar(&fetchOpts.Resume, "resume", false, "continue from the checkpoint of an interrupted fetch")
+	fetchCmd.Flags().IntVar(&fetchOpts.Concurrency, "concurrency", 10, "maximum number of calls in flight to each AWS API")
+	fetchCmd.Flags().IntVar(&fetchOpts.TagsConcurrency, "tags-concurrency", 0, "number of accounts whose tags are fetched at the same time (default --concurrency)")
+	fetchCmd.Flags().IntVar(&fetchOpts.AliasConcurrency, "alias-concurrency", 0, "number of accounts whose aliases are fetched at the same time (default --concurrency)")
+	fetchCmd.Flags().Float64Var(&fetchOpts.RPS, "rps", 0, "requests per second to each AWS API (default: per API quota)")
+	fetchCmd.Flags().StringVar(&fetchOpts.SSO.Session, "sso-session", "", "fetch through IAM Identity Center with this sso-session from ~/.aws/config")
+	fetchCmd.Flags().StringVar(&fetchOpts.SSO.StartURL, "sso-start-url", "", "fetch through the IAM Identity Center portal with this start URL")
+	fetchCmd.Flags().StringVar(&fetchOpts.SSO.Region, "sso-region", "", "the region of the IAM Identity Center portal")
+	fetchCmd.Flags().StringVar(&fetchSourceFile, "source-file", "", "fetch the accounts in this JSON file, shaped like the state file, instead of from AWS")
+	fetchCmd.Flags().BoolVar(&fetchFailOnErrors, "fail-on-errors", false, "exit non-zero if the alias or tags of any account could not be fetched")
+
+	importCmd.Flags().StringVar(&importOpts.Org, "org", "", "import into the state of this organization from the settings file")
+	importCmd.Flags().StringVar(&importOpts.Format, "format", "", "format of <file>: csv, yaml or json (default: from its extension)")
+	importCmd.Flags().BoolVar(&importOpts.Merge, "merge", false, "merge the accounts into the existing state instead of replacing it")
+	importCmd.Flags().BoolVar(&importOpts.Force, "force", false, "replace the existing state even if it was written by fetch")
+
+	for _, c := range list.Columns {
+		listCmd.Long += fmt.Sprintf("    %-10s %s\n", c.Name, c.Description)
+	}
+	listCmd.Flags().StringVar(&listOpts.Format, "output", "table", "output format: "+strings.Join(list.FormatNames, ", "))
+	listCmd.Flags().StringArrayVar(&listOpts.Orgs, "org", nil, "only list accounts of this organization from the settings file")
+	listCmd.Flags().StringArrayVar(&listOpts.Statuses, "status", nil, "only list accounts with this status, e.g. ACTIVE")
+	listCmd.Flags().StringArrayVar(&listOpts.OUs, "ou", nil, "only list accounts beneath this root or organizational unit, by name or ID")
+	listCmd.Flags().StringArrayVar(&listOpts.Tags, "tag", nil, "only list accounts with this effective tag, given as key or key=value")
+	listCmd.Flags().BoolVar(&listOpts.HasAlias, "has-alias", false, "only list accounts with an alias")
+	listCmd.Flags().StringVar(&listOpts.AliasGlob, "alias-glob", "", "only list accounts whose alias matches this glob, e.g. 'data-*'")
+	listCmd.Flags().StringVar(&listOpts.Query, "query", "", "JMESPath expression to filter the accounts with")
+	listCmd.Flags().StringArrayVar(&listOpts.Columns, "columns", nil, "columns to print (default "+strings.Join(list.DefaultColumns, ",")+")")
+	listCmd.Flags().StringArrayVar(&listOpts.Sort, "sort", nil, "columns to sort by, descending when prefixed with - (default id)")
+
+	whoisCmd.Flags().BoolVar(&whoisJSON, "json", false, "print the matching accounts as JSON")
+
+	diffCmd.Flags().StringVar(&diffOrg, "org", "", "compare the snapshots of this organization from the settings file")
+	diffCmd.Flags().BoolVar(&diffJSON, "json", false, "print the changes as JSON")
+	diffCmd.Flags().BoolVar(&diffList, "list", false, "list the snapshots instead")
+	diffCmd.Flags().BoolVar(&diffExitCode, "exit-code", false, "exit with 1 if anything changed")
+}
+
 func Execute() {
 	rootCmd.AddCommand(
 		fetchCmd,
 		upsertCmd,
 		initCmd,
+		diffCmd,
+		importCmd,
+		listCmd,
+		whoisCmd,
 	)
 
 	if err := rootCmd.Execute(); err != nil {
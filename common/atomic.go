@@ -0,0 +1,96 @@
+package common
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// WriteFileAtomic writes data to the file at path such that readers, and a
+// crash, see either the old or the new contents but never a truncated file.
+// The data is written to a temporary file in the same directory, synced and
+// renamed over the file. When path is a symlink, the file it points to is
+// replaced and the symlink kept. An existing file keeps its permissions and
+// ownership; a new one is created with perm.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) (err error) {
+	target, err := resolveSymlinks(path)
+	if err != nil {
+		return
+	}
+
+	info, err := os.Stat(target)
+	if err == nil {
+		perm = info.Mode().Perm()
+	} else if !os.IsNotExist(err) {
+		return
+	}
+
+	dir, name := filepath.Split(target)
+	f, err := ioutil.TempFile(dir, "."+name+".tmp-")
+	if err != nil {
+		return
+	}
+	tmp := f.Name()
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(tmp)
+		}
+	}()
+
+	if _, err = f.Write(data); err != nil {
+		return
+	}
+	if err = f.Chmod(perm); err != nil {
+		return
+	}
+	if info != nil {
+		if err = chown(f, info); err != nil {
+			return fmt.Errorf("Could not preserve the ownership of %s: %v", target, err)
+		}
+	}
+	if err = f.Sync(); err != nil {
+		return
+	}
+	if err = f.Close(); err != nil {
+		return
+	}
+
+	if err = os.Rename(tmp, target); err != nil {
+		return
+	}
+
+	syncDir(dir)
+
+	return nil
+}
+
+// resolveSymlinks returns the path of the file the symlink at path, possibly
+// through other symlinks, points to, or path itself when it is not a symlink.
+// The file pointed to need not exist.
+func resolveSymlinks(path string) (string, error) {
+	for i := 0; i < 40; i++ {
+		info, err := os.Lstat(path)
+		if os.IsNotExist(err) {
+			return path, nil
+		}
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			return path, nil
+		}
+
+		link, err := os.Readlink(path)
+		if err != nil {
+			return "", err
+		}
+		if !filepath.IsAbs(link) {
+			link = filepath.Join(filepath.Dir(path), link)
+		}
+		path = link
+	}
+
+	return "", fmt.Errorf("Too many levels of symlinks at %s", path)
+}
@@ -0,0 +1,144 @@
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// tempDir returns a new directory removed when the test ends.
+func tempDir(t *testing.T) string {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "common-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	return dir
+}
+
+// readFile returns the contents of the file at path.
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(data)
+}
+
+// tempFiles returns the names of the temporary files WriteFileAtomic left in
+// dir.
+func tempFiles(t *testing.T, dir string) (names []string) {
+	t.Helper()
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, info := range infos {
+		if strings.Contains(info.Name(), ".tmp-") {
+			names = append(names, info.Name())
+		}
+	}
+
+	return
+}
+
+func TestWriteFileAtomicSymlink(t *testing.T) {
+	dir := tempDir(t)
+	target := filepath.Join(dir, "dotfiles", "config")
+	link := filepath.Join(dir, "config")
+
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(target, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join("dotfiles", "config"), link); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := WriteFileAtomic(link, []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Lstat(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("%s was replaced instead of the file it points to", link)
+	}
+	if got := readFile(t, target); got != "new" {
+		t.Errorf("%s contains %q, want %q", target, got, "new")
+	}
+	if names := tempFiles(t, filepath.Dir(target)); len(names) != 0 {
+		t.Errorf("temporary files left behind: %v", names)
+	}
+}
+
+func TestWriteFileAtomicPermissions(t *testing.T) {
+	dir := tempDir(t)
+
+	existing := filepath.Join(dir, "existing")
+	if err := ioutil.WriteFile(existing, []byte("old"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(existing, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFileAtomic(existing, []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	created := filepath.Join(dir, "created")
+	if err := WriteFileAtomic(created, []byte("new"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path string
+		perm os.FileMode
+	}{
+		{existing, 0600},
+		{created, 0640},
+	}
+
+	for _, tt := range tests {
+		info, err := os.Stat(tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perm := info.Mode().Perm(); perm != tt.perm {
+			t.Errorf("%s has permissions %v, want %v", filepath.Base(tt.path), perm, tt.perm)
+		}
+		if got := readFile(t, tt.path); got != "new" {
+			t.Errorf("%s contains %q, want %q", filepath.Base(tt.path), got, "new")
+		}
+	}
+}
+
+func TestWriteFileAtomicError(t *testing.T) {
+	dir := tempDir(t)
+
+	// A file cannot be renamed over a directory.
+	path := filepath.Join(dir, "state.json")
+	if err := os.Mkdir(path, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := WriteFileAtomic(path, []byte("new"), 0644); err == nil {
+		t.Fatalf("WriteFileAtomic over a directory succeeded")
+	}
+	if names := tempFiles(t, dir); len(names) != 0 {
+		t.Errorf("temporary files left behind: %v", names)
+	}
+}
@@ -0,0 +1,13 @@
+package common
+
+import (
+	"os"
+)
+
+// chown does nothing, as files on Windows have no Unix owner.
+func chown(f *os.File, info os.FileInfo) error {
+	return nil
+}
+
+// syncDir does nothing, as directories cannot be synced on Windows.
+func syncDir(dir string) {}
@@ -0,0 +1,156 @@
+package common
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// The state backends selectable with the Backend state setting.
+const (
+	LocalBackend = "local"
+	HTTPBackend  = "http"
+	S3Backend    = "s3"
+)
+
+// StateBackend stores the state files of organizations, by name, e.g.
+// state.json or state-prod.json. Checkpoints and snapshots are always kept
+// locally.
+type StateBackend interface {
+	// Read returns the contents of the named state file, or an error for
+	// which os.IsNotExist is true if there is none.
+	Read(name string) ([]byte, error)
+
+	// Write replaces the contents of the named state file.
+	Write(name string, data []byte) error
+
+	// Location returns where the named state file is stored, e.g. a path
+	// or URL, for messages.
+	Location(name string) string
+}
+
+var (
+	backendOnce sync.Once
+	backend     StateBackend
+)
+
+// GetStateBackend returns the state backend selected in the settings file,
+// the local aliased-profiles directory by default.
+func GetStateBackend() StateBackend {
+	backendOnce.Do(func() {
+		var err error
+		backend, err = NewStateBackend(ReadSettings().State)
+		ExitWithError(err)
+	})
+
+	return backend
+}
+
+// NewStateBackend returns the state backend described by s.
+func NewStateBackend(s StateSettings) (StateBackend, error) {
+	switch s.Backend {
+	case "", LocalBackend:
+		return &localBackend{}, nil
+	case HTTPBackend:
+		return newHTTPBackend(s)
+	case S3Backend:
+		return newS3Backend(s)
+	}
+
+	return nil, fmt.Errorf("Unknown state backend %q, expected %s, %s or %s", s.Backend, LocalBackend, HTTPBackend, S3Backend)
+}
+
+// localBackend keeps state files in the aliased-profiles directory.
+type localBackend struct{}
+
+func (b *localBackend) Read(name string) ([]byte, error) {
+	return ioutil.ReadFile(b.Location(name))
+}
+
+func (b *localBackend) Write(name string, data []byte) error {
+	return WriteFileAtomic(b.Location(name), data, 0644)
+}
+
+func (b *localBackend) Location(name string) string {
+	return GetAPPath(name)
+}
+
+// notExist returns an error for which os.IsNotExist is true.
+func notExist(location string) error {
+	return &os.PathError{Op: "read", Path: location, Err: os.ErrNotExist}
+}
+
+// etags records the entity tag of each state file the first time it is read
+// by a remote backend, so that writing it back only succeeds if no other run
+// replaced it in the meantime. Fetch and import read the state as they start
+// for this reason.
+type etags struct {
+	mu   sync.Mutex
+	seen map[string]seenState
+}
+
+// seenState is what a remote backend returned when a state file was read.
+type seenState struct {
+	// Whether the state file existed.
+	exists bool
+
+	// Its entity tag, which may be empty for stores that return none.
+	etag string
+}
+
+// read records the tag of the named state file, which exists, unless one was
+// already recorded.
+func (e *etags) read(name, etag string) {
+	e.record(name, seenState{exists: true, etag: etag}, false)
+}
+
+// missing records that the named state file did not exist unless something
+// was already recorded.
+func (e *etags) missing(name string) {
+	e.record(name, seenState{}, false)
+}
+
+// written records the tag of the named state file just written.
+func (e *etags) written(name, etag string) {
+	e.record(name, seenState{exists: true, etag: etag}, true)
+}
+
+func (e *etags) record(name string, s seenState, replace bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.seen == nil {
+		e.seen = make(map[string]seenState)
+	}
+	if _, ok := e.seen[name]; replace || !ok {
+		e.seen[name] = s
+	}
+}
+
+// precondition returns the conditional request header, and its value, that
+// a write of the named state file should carry, if any. A state file that
+// was read without an entity tag is written unconditionally, since there is
+// nothing to compare it with.
+func (e *etags) precondition(name string) (header, value string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	s, ok := e.seen[name]
+	switch {
+	case !ok:
+		return "", ""
+	case !s.exists:
+		return "If-None-Match", "*"
+	case s.etag == "":
+		return "", ""
+	}
+
+	return "If-Match", s.etag
+}
+
+// conflict returns the error for a write rejected because the state file
+// changed since it was read.
+func conflict(location string) error {
+	return fmt.Errorf("The state at %s was replaced by another run since it was read, please fetch again", location)
+}
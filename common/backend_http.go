@@ -0,0 +1,106 @@
+package common
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// httpBackend keeps state files at a URL read with GET and written with PUT.
+// Writes are conditional on the ETag returned when the state was read.
+type httpBackend struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+	etags   etags
+}
+
+func newHTTPBackend(s StateSettings) (*httpBackend, error) {
+	if s.URL == "" {
+		return nil, fmt.Errorf("The http state backend needs a URL")
+	}
+
+	// Values may refer to environment variables so that tokens need not be
+	// kept in the settings file, e.g. "Bearer ${STATE_TOKEN}".
+	headers := make(map[string]string, len(s.Headers))
+	for k, v := range s.Headers {
+		headers[k] = os.ExpandEnv(v)
+	}
+
+	return &httpBackend{
+		url:     strings.TrimSuffix(s.URL, "/") + "/",
+		headers: headers,
+		client:  &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+func (b *httpBackend) Location(name string) string {
+	return b.url + name
+}
+
+func (b *httpBackend) Read(name string) (data []byte, err error) {
+	resp, err := b.do(http.MethodGet, name, nil, nil)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		b.etags.missing(name)
+		return nil, notExist(b.Location(name))
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Could not read %s: %s", b.Location(name), resp.Status)
+	}
+
+	if data, err = ioutil.ReadAll(resp.Body); err != nil {
+		return
+	}
+	b.etags.read(name, resp.Header.Get("ETag"))
+
+	return
+}
+
+func (b *httpBackend) Write(name string, data []byte) (err error) {
+	headers := map[string]string{"Content-Type": "application/json"}
+	if header, value := b.etags.precondition(name); header != "" {
+		headers[header] = value
+	}
+
+	resp, err := b.do(http.MethodPut, name, data, headers)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusPreconditionFailed {
+		return conflict(b.Location(name))
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Could not write %s: %s", b.Location(name), resp.Status)
+	}
+
+	b.etags.written(name, resp.Header.Get("ETag"))
+
+	return nil
+}
+
+func (b *httpBackend) do(method, name string, body []byte, headers map[string]string) (*http.Response, error) {
+	req, err := http.NewRequest(method, b.Location(name), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range b.headers {
+		req.Header.Set(k, v)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	return b.client.Do(req)
+}
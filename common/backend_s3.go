@@ -0,0 +1,117 @@
+package common
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// s3Backend keeps state files as objects in an S3, or S3-compatible, bucket.
+// Writes are conditional on the ETag returned when the state was read, which
+// stores without conditional writes ignore.
+type s3Backend struct {
+	bucket string
+	prefix string
+	client *s3.S3
+	etags  etags
+}
+
+func newS3Backend(s StateSettings) (*s3Backend, error) {
+	if s.Bucket == "" {
+		return nil, fmt.Errorf("The s3 state backend needs a Bucket")
+	}
+
+	config := aws.Config{S3ForcePathStyle: aws.Bool(s.PathStyle)}
+	if s.Region != "" {
+		config.Region = aws.String(s.Region)
+	}
+	if s.Endpoint != "" {
+		config.Endpoint = aws.String(s.Endpoint)
+	}
+
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            config,
+		Profile:           s.Profile,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &s3Backend{
+		bucket: s.Bucket,
+		prefix: s.Prefix,
+		client: s3.New(sess),
+	}, nil
+}
+
+func (b *s3Backend) key(name string) string {
+	return path.Join(b.prefix, name)
+}
+
+func (b *s3Backend) Location(name string) string {
+	return fmt.Sprintf("s3://%s/%s", b.bucket, b.key(name))
+}
+
+func (b *s3Backend) Read(name string) (data []byte, err error) {
+	o, err := b.client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(b.key(name)),
+	})
+	if isNotFound(err) {
+		b.etags.missing(name)
+		return nil, notExist(b.Location(name))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Could not read %s: %v", b.Location(name), err)
+	}
+	defer o.Body.Close()
+
+	if data, err = ioutil.ReadAll(o.Body); err != nil {
+		return
+	}
+	b.etags.read(name, aws.StringValue(o.ETag))
+
+	return
+}
+
+func (b *s3Backend) Write(name string, data []byte) (err error) {
+	req, o := b.client.PutObjectRequest(&s3.PutObjectInput{
+		Bucket:      aws.String(b.bucket),
+		Key:         aws.String(b.key(name)),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String("application/json"),
+	})
+	if header, value := b.etags.precondition(name); header != "" {
+		req.HTTPRequest.Header.Set(header, value)
+	}
+
+	if err = req.Send(); err != nil {
+		if e, ok := err.(awserr.RequestFailure); ok && (e.StatusCode() == http.StatusPreconditionFailed || e.StatusCode() == http.StatusConflict) {
+			return conflict(b.Location(name))
+		}
+		return fmt.Errorf("Could not write %s: %v", b.Location(name), err)
+	}
+
+	b.etags.written(name, aws.StringValue(o.ETag))
+
+	return nil
+}
+
+func isNotFound(err error) bool {
+	if e, ok := err.(awserr.RequestFailure); ok && e.StatusCode() == http.StatusNotFound {
+		return true
+	}
+	if e, ok := err.(awserr.Error); ok && e.Code() == s3.ErrCodeNoSuchKey {
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,227 @@
+package common
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// stateServer is a store of state files that honours If-Match and
+// If-None-Match on PUT, like the servers the http and s3 backends are used
+// with.
+type stateServer struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	objects map[string]string
+	version int
+
+	// Whether ETags are left out of responses.
+	noETags bool
+
+	// The conditional headers of the last PUT.
+	ifMatch     string
+	ifNoneMatch string
+}
+
+func newStateServer(t *testing.T) *stateServer {
+	s := &stateServer{objects: make(map[string]string)}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+func (s *stateServer) etag(body string) string {
+	return fmt.Sprintf(`"%d-%d"`, len(body), s.version)
+}
+
+// setNoETags sets whether ETags are left out of responses.
+func (s *stateServer) setNoETags(noETags bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.noETags = noETags
+}
+
+// conditions returns the If-Match and If-None-Match headers of the last PUT.
+func (s *stateServer) conditions() (ifMatch, ifNoneMatch string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.ifMatch, s.ifNoneMatch
+}
+
+// put replaces the named object, as another run would.
+func (s *stateServer) put(name, body string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.version++
+	s.objects[name] = body
+}
+
+func (s *stateServer) serve(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	body, exists := s.objects[r.URL.Path]
+	current := s.etag(body)
+
+	switch r.Method {
+	case http.MethodGet:
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if !s.noETags {
+			w.Header().Set("ETag", current)
+		}
+		fmt.Fprint(w, body)
+
+	case http.MethodPut:
+		s.ifMatch = r.Header.Get("If-Match")
+		s.ifNoneMatch = r.Header.Get("If-None-Match")
+		if (s.ifMatch != "" && (!exists || s.ifMatch != current)) || (s.ifNoneMatch == "*" && exists) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+
+		data, _ := ioutil.ReadAll(r.Body)
+		s.version++
+		s.objects[r.URL.Path] = string(data)
+		if !s.noETags {
+			w.Header().Set("ETag", s.etag(string(data)))
+		}
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// backends returns an http and an s3 backend storing state in s.
+func backends(t *testing.T, s *stateServer) map[string]func() StateBackend {
+	setenv(t, "AWS_ACCESS_KEY_ID", "test")
+	setenv(t, "AWS_SECRET_ACCESS_KEY", "test")
+	setenv(t, "AWS_CONFIG_FILE", os.DevNull)
+	setenv(t, "AWS_SHARED_CREDENTIALS_FILE", os.DevNull)
+	setenv(t, "AWS_PROFILE", "")
+
+	newBackend := func(settings StateSettings) func() StateBackend {
+		return func() StateBackend {
+			b, err := NewStateBackend(settings)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return b
+		}
+	}
+
+	return map[string]func() StateBackend{
+		HTTPBackend: newBackend(StateSettings{Backend: HTTPBackend, URL: s.URL + "/http"}),
+		S3Backend: newBackend(StateSettings{
+			Backend:   S3Backend,
+			Bucket:    "bucket",
+			Prefix:    "s3",
+			Region:    "us-east-1",
+			Endpoint:  s.URL,
+			PathStyle: true,
+		}),
+	}
+}
+
+// setenv sets, or unsets when value is empty, an environment variable until
+// the end of the test.
+func setenv(t testing.TB, key, value string) {
+	prev, ok := os.LookupEnv(key)
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, prev)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+
+	if value == "" {
+		os.Unsetenv(key)
+	} else {
+		os.Setenv(key, value)
+	}
+}
+
+func TestStateBackendConflicts(t *testing.T) {
+	s := newStateServer(t)
+
+	for kind, newBackend := range backends(t, s) {
+		path := "/" + kind + "/state.json"
+		if kind == S3Backend {
+			path = "/bucket/s3/state.json"
+		}
+
+		t.Run(kind, func(t *testing.T) {
+			s.setNoETags(false)
+
+			// The state does not exist yet, so the write may only create it.
+			b := newBackend()
+			if _, err := b.Read("state.json"); !os.IsNotExist(err) {
+				t.Fatalf("Read returned %v, want a not exist error", err)
+			}
+			if err := b.Write("state.json", []byte("1")); err != nil {
+				t.Fatal(err)
+			}
+			if ifMatch, ifNoneMatch := s.conditions(); ifNoneMatch != "*" || ifMatch != "" {
+				t.Errorf("the first write sent If-Match %q and If-None-Match %q, want only If-None-Match *", ifMatch, ifNoneMatch)
+			}
+
+			// Writing again is conditional on the ETag just written.
+			if err := b.Write("state.json", []byte("2")); err != nil {
+				t.Fatal(err)
+			}
+			if ifMatch, _ := s.conditions(); ifMatch == "" {
+				t.Error("the second write sent no If-Match")
+			}
+
+			// Another run reads the state and writes it back.
+			b = newBackend()
+			data, err := b.Read("state.json")
+			if err != nil || string(data) != "2" {
+				t.Fatalf("Read returned %q and %v, want 2", data, err)
+			}
+			if err := b.Write("state.json", []byte("3")); err != nil {
+				t.Fatal(err)
+			}
+			if ifMatch, _ := s.conditions(); ifMatch == "" {
+				t.Error("the write after a read sent no If-Match")
+			}
+
+			// The state is replaced between reading and writing it.
+			b = newBackend()
+			if _, err := b.Read("state.json"); err != nil {
+				t.Fatal(err)
+			}
+			s.put(path, "other")
+			err = b.Write("state.json", []byte("4"))
+			if err == nil || !strings.Contains(err.Error(), "replaced by another run") {
+				t.Errorf("Write returned %v, want a conflict", err)
+			}
+
+			// A state read without an ETag is written unconditionally.
+			s.setNoETags(true)
+			b = newBackend()
+			if _, err := b.Read("state.json"); err != nil {
+				t.Fatal(err)
+			}
+			if err := b.Write("state.json", []byte("5")); err != nil {
+				t.Errorf("Write of a state read without an ETag returned %v", err)
+			}
+			if ifMatch, ifNoneMatch := s.conditions(); ifMatch != "" || ifNoneMatch != "" {
+				t.Errorf("the write sent If-Match %q and If-None-Match %q, want neither", ifMatch, ifNoneMatch)
+			}
+		})
+	}
+}
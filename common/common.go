@@ -2,18 +2,20 @@ package common
 
 import (
 	"context"
-	"encoding/json"
-	"io/ioutil"
+	"fmt"
 	"os"
 	"os/signal"
+	"sort"
 	"strings"
 	"syscall"
 	"time"
+	"unicode"
 )
 
 const (
 	DirName                = "aliased-profiles"
 	StateFilename          = "state.json"
+	SettingsFilename       = "settings.json"
 	ConfigFilename         = "config.tmpl"
 	AWSConfigFilename      = "config"
 	DefaultProfileTemplate = `
@@ -21,28 +23,151 @@ const (
 cli_pager=
 source_profile = default
 {{- if .HasTagKeyValue "environment" "staging" }}
-role_arn = arn:aws:iam::{{ .Id }}:role/Staging
+role_arn = {{ .RoleArn "Staging" }}
 {{ else }}
-role_arn = arn:aws:iam::{{ .Id }}:role/Production
+role_arn = {{ .RoleArn "Production" }}
 {{ end -}}
 {{ end -}}
 
 [profile {{ .Id }}]
 {{- template "profileBody" . -}}
 
-{{- if .Alias }}
-[profile {{ .Alias }}]
+{{- if .ProfileName }}
+[profile {{ .ProfileName }}]
 {{- template "profileBody" . -}}
 {{ end -}}
+`
+	// DefaultSSOProfileTemplate names a profile after each account and role
+	// assigned in IAM Identity Center.
+	DefaultSSOProfileTemplate = `
+{{- $name := .ProfileName }}{{ if not $name }}{{ $name = .Id }}{{ end }}
+{{- range .Roles }}
+[profile {{ $name }}-{{ slugify . }}]
+{{- if $.Org.SSOSession }}
+sso_session = {{ $.Org.SSOSession }}
+{{- else }}
+sso_start_url = {{ $.Org.SSOStartURL }}
+sso_region = {{ $.Org.SSORegion }}
+{{- end }}
+sso_account_id = {{ $.Id }}
+sso_role_name = {{ . }}
+{{ end -}}
 `
 	AWSConfigDelimiter = "### ----- AWS Aliased Profiles -----"
+	DefaultPartition   = "aws"
 )
 
+// Version is the version of aws-aliased-profiles, recorded in the state it
+// writes. Release builds set it with
+// -ldflags "-X github.com/logston/aws-aliased-profiles/common.Version=v1.2.3".
+var Version = "dev"
+
 type Tag struct {
 	Key   string
 	Value string
 }
 
+// FetchTimes records when each separately fetched attribute of an account
+// was last read from AWS. A zero time means the attribute was never fetched.
+type FetchTimes struct {
+	Alias time.Time
+	Tags  time.Time
+	Roles time.Time
+}
+
+// The outcomes of fetching an attribute of an account.
+const (
+	FetchOK                = "ok"
+	FetchAssumeRoleDenied  = "assume-role-denied"
+	FetchListAliasesDenied = "list-aliases-denied"
+	FetchListTagsDenied    = "list-tags-denied"
+	FetchListRolesDenied   = "list-roles-denied"
+	FetchThrottled         = "throttled"
+	FetchFailed            = "error"
+)
+
+// FetchOutcome is the result of the last attempt to fetch an attribute of an
+// account.
+type FetchOutcome struct {
+	// One of the Fetch* outcome constants, or empty if the attribute was
+	// never fetched.
+	Status string
+
+	// The error returned by AWS when Status is not FetchOK.
+	Error string `json:",omitempty"`
+}
+
+// Failed reports whether the attribute was fetched unsuccessfully.
+func (o FetchOutcome) Failed() bool {
+	return o.Status != "" && o.Status != FetchOK
+}
+
+// FetchOutcomes records the outcome of fetching each separately fetched
+// attribute of an account.
+type FetchOutcomes struct {
+	Alias FetchOutcome
+	Tags  FetchOutcome
+	Roles FetchOutcome
+}
+
+type Organization struct {
+	// The name of the organization in the settings file. It is empty for the
+	// organization fetched with a profile and role on the command line.
+	Name string
+
+	// The unique identifier (ID) of the organization.
+	Id string
+
+	// The unique identifier (ID) of the management account of the
+	// organization.
+	MasterAccountId string
+
+	// The functionality available to the organization, "ALL" or
+	// "CONSOLIDATED_BILLING".
+	FeatureSet string
+
+	// Prepended to the profile name of each account in the organization.
+	ProfilePrefix string
+
+	// The AWS partition of the organization, e.g. "aws" or "aws-us-gov".
+	Partition string
+
+	// The IAM Identity Center session, or start URL and region, that the
+	// accounts were fetched from, if any.
+	SSOSession  string
+	SSOStartURL string
+	SSORegion   string
+}
+
+// Label returns a name for the organization suitable for messages.
+func (o *Organization) Label() string {
+	if o.Name != "" {
+		return o.Name
+	}
+	if o.Id != "" {
+		return o.Id
+	}
+
+	return "the default organization"
+}
+
+type OrganizationalUnit struct {
+	// The unique identifier (ID) of the root or organizational unit.
+	Id string
+
+	// The friendly name of the root or organizational unit.
+	Name string
+
+	// The tags on the root or organizational unit, which the accounts beneath
+	// it inherit.
+	Tags []*Tag
+
+	// The outcome of the last attempt to fetch the tags. The accounts beneath
+	// a root or organizational unit whose tags could not be fetched are
+	// missing the tags they would inherit from it.
+	FetchOutcome FetchOutcome
+}
+
 type Account struct {
 	// The unique identifier (ID) of the account.
 	//
@@ -50,6 +175,15 @@ type Account struct {
 	// requires exactly 12 digits.
 	Id string
 
+	// The friendly name of the account.
+	Name string
+
+	// The email address associated with the account.
+	Email string
+
+	// The Amazon Resource Name (ARN) of the account.
+	Arn string
+
 	// The date the account became a part of the organization.
 	JoinedTimestamp time.Time
 
@@ -59,7 +193,35 @@ type Account struct {
 	// Alias associated with the account.
 	Alias string
 
+	// The first of the fetch roles that could be assumed in the account,
+	// preferring one that could also read the alias.
+	AssumableRole string
+
 	Tags []*Tag
+
+	// The roles in the account, optionally preceded by their path, e.g.
+	// "Admin" or "team/ReadOnly", that the fetch profile could assume. Only
+	// discovered when role discovery is configured.
+	Roles []string
+
+	// The organizational units between the root and the account, starting
+	// with the root itself.
+	OUs []*OrganizationalUnit
+
+	// When the alias, tags and roles of the account were last fetched.
+	FetchedAt FetchTimes
+
+	// The outcome of the last attempt to fetch the alias, tags and roles of
+	// the account.
+	FetchOutcome FetchOutcomes
+
+	// The organization the account was fetched from.
+	Org *Organization
+
+	// Whether the name slug is left out of the profile name because another
+	// account in the organization has the same profile name or ID. Set by
+	// DropCollidingNameSlugs.
+	nameSlugDropped bool
 }
 
 func (a *Account) HasTagKeyValue(key, value string) bool {
@@ -72,6 +234,173 @@ func (a *Account) HasTagKeyValue(key, value string) bool {
 	return false
 }
 
+// EffectiveTags returns the tags of the account merged with those inherited
+// from its root and organizational units, sorted by key. A tag on the account
+// overrides the same tag on any organizational unit, and a tag on an
+// organizational unit overrides the same tag on any unit above it.
+func (a *Account) EffectiveTags() []*Tag {
+	values := make(map[string]string)
+	for _, ou := range a.OUs {
+		for _, t := range ou.Tags {
+			values[t.Key] = t.Value
+		}
+	}
+	for _, t := range a.Tags {
+		values[t.Key] = t.Value
+	}
+
+	tags := make([]*Tag, 0, len(values))
+	for k, v := range values {
+		tags = append(tags, &Tag{Key: k, Value: v})
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i].Key < tags[j].Key })
+
+	return tags
+}
+
+// HasEffectiveTagKeyValue is HasTagKeyValue for the effective tags of the
+// account, including those inherited from its organizational units.
+func (a *Account) HasEffectiveTagKeyValue(key, value string) bool {
+	for _, t := range a.EffectiveTags() {
+		if t.Key == key && t.Value == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// EffectiveTag returns the value of the effective tag of the account with the
+// given key, or an empty string if there is none.
+func (a *Account) EffectiveTag(key string) string {
+	for _, t := range a.Tags {
+		if t.Key == key {
+			return t.Value
+		}
+	}
+
+	for i := len(a.OUs) - 1; i >= 0; i-- {
+		for _, t := range a.OUs[i].Tags {
+			if t.Key == key {
+				return t.Value
+			}
+		}
+	}
+
+	return ""
+}
+
+// NameSlug returns the account name lower cased with every run of characters
+// other than letters and digits replaced by a single hyphen, e.g.
+// "Data Platform (Prod)" becomes "data-platform-prod".
+func (a *Account) NameSlug() string {
+	return Slugify(a.Name)
+}
+
+// ProfileName returns the alias of the account or, for accounts without an
+// alias, the slug of its name, prefixed with the profile prefix of its
+// organization. It is empty if the account has neither an alias nor a name,
+// or if its name slug was dropped by DropCollidingNameSlugs.
+func (a *Account) ProfileName() string {
+	name := a.Alias
+	if name == "" && !a.nameSlugDropped {
+		name = a.NameSlug()
+	}
+
+	if name == "" || a.Org == nil {
+		return name
+	}
+
+	return a.Org.ProfilePrefix + name
+}
+
+// Partition returns the AWS partition of the account's organization, e.g.
+// "aws" or "aws-us-gov".
+func (a *Account) Partition() string {
+	if a.Org == nil || a.Org.Partition == "" {
+		return DefaultPartition
+	}
+
+	return a.Org.Partition
+}
+
+// RoleArn returns the ARN of the role with the given name, optionally
+// preceded by a path, e.g. "ReadOnly" or "team/ReadOnly", in the account.
+func (a *Account) RoleArn(role string) string {
+	return RoleArn(a.Partition(), a.Id, role)
+}
+
+// InOU reports whether the account lives anywhere beneath the root or
+// organizational unit with the given name or ID.
+func (a *Account) InOU(nameOrId string) bool {
+	for _, ou := range a.OUs {
+		if ou.Name == nameOrId || ou.Id == nameOrId {
+			return true
+		}
+	}
+
+	return false
+}
+
+// OUPath returns the names of the account's organizational units joined by
+// slashes, e.g. "Root/Workloads/Prod".
+func (a *Account) OUPath() string {
+	names := make([]string, 0, len(a.OUs))
+	for _, ou := range a.OUs {
+		names = append(names, ou.Name)
+	}
+
+	return strings.Join(names, "/")
+}
+
+// OUIdPath returns the IDs of the account's organizational units joined by
+// slashes, e.g. "r-ab12/ou-ab12-11111111/ou-ab12-22222222".
+func (a *Account) OUIdPath() string {
+	ids := make([]string, 0, len(a.OUs))
+	for _, ou := range a.OUs {
+		ids = append(ids, ou.Id)
+	}
+
+	return strings.Join(ids, "/")
+}
+
+// RoleArn returns the ARN of a role in an account. The role name may be
+// preceded by a path, and optionally "role/", e.g. "ReadOnly",
+// "team/ReadOnly" or "role/team/ReadOnly".
+func RoleArn(partition, accountId, role string) string {
+	role = strings.TrimPrefix(role, "/")
+	role = strings.TrimPrefix(role, "role/")
+	role = strings.TrimPrefix(role, "/")
+
+	return fmt.Sprintf("arn:%s:iam::%s:role/%s", partition, accountId, role)
+}
+
+// RoleName returns the name of a role without its path, e.g. "ReadOnly" for
+// "team/ReadOnly".
+func RoleName(role string) string {
+	return role[strings.LastIndex(role, "/")+1:]
+}
+
+// Slugify lower cases s and replaces every run of characters other than
+// letters and digits with a single hyphen.
+func Slugify(s string) string {
+	var b strings.Builder
+	hyphen := false
+	for _, r := range strings.ToLower(s) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if hyphen && b.Len() > 0 {
+				b.WriteRune('-')
+			}
+			b.WriteRune(r)
+			hyphen = false
+		} else {
+			hyphen = true
+		}
+	}
+
+	return b.String()
+}
+
 func NewCtx() context.Context {
 	ctx, cancel := context.WithCancel(context.Background())
 	go func() {
@@ -98,34 +427,6 @@ func ExitWithError(err error) {
 	}
 }
 
-func WriteAccountList(al []*Account) {
-	data, err := json.MarshalIndent(al, "", "    ")
-	if err != nil {
-		ExitWithError(err)
-	}
-
-	path := GetAPPath(StateFilename)
-
-	if err := ioutil.WriteFile(path, data, 0644); err != nil {
-		ExitWithError(err)
-	}
-}
-
-func ReadAccountList() (al []*Account) {
-	path := GetAPPath(StateFilename)
-
-	data, err := ioutil.ReadFile(path)
-	if err != nil {
-		ExitWithError(err)
-	}
-
-	if err := json.Unmarshal(data, &al); err != nil {
-		ExitWithError(err)
-	}
-
-	return
-}
-
 func GetAWSPath(files ...string) string {
 	home, err := os.UserHomeDir()
 	if err != nil {
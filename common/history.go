@@ -0,0 +1,177 @@
+package common
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	HistoryDirName = "history"
+
+	// DefaultHistorySize is the number of previous state files kept for
+	// each organization unless HistorySize is set.
+	DefaultHistorySize = 10
+
+	// snapshotTimeLayout is the layout of the time a snapshot was written in
+	// its file name, e.g. state-20210101T000000Z.json. Snapshots of states
+	// fetched in the same second are numbered from 2 after the time, e.g.
+	// state-20210101T000000Z-2.json.
+	snapshotTimeLayout = "20060102T150405Z"
+)
+
+// Snapshot is a previous state file of an organization kept in the history
+// directory.
+type Snapshot struct {
+	// The file name of the snapshot, e.g. state-prod-20210101T000000Z.json.
+	Name string
+	Path string
+
+	// When the fetch that wrote the state file finished.
+	Time time.Time
+
+	// The number of the snapshot among those of the same Time, from 1.
+	seq int
+}
+
+// GetHistoryPath returns the path of the history directory, or of the given
+// file in it.
+func GetHistoryPath(files ...string) string {
+	return GetAPPath(append([]string{HistoryDirName}, files...)...)
+}
+
+// snapshotPrefix returns the prefix of the names of the snapshots of the
+// organization, e.g. "state-prod-".
+func snapshotPrefix(org string) string {
+	return strings.TrimSuffix(GetStateName(org), ".json") + "-"
+}
+
+// SnapshotState saves data, the state file of the organization about to be
+// replaced, in the history directory, named after the time it was fetched,
+// and removes the oldest snapshots beyond the HistorySize setting.
+func SnapshotState(org string, data []byte) {
+	size := ReadSettings().HistorySize
+	if size == 0 {
+		size = DefaultHistorySize
+	}
+	if size < 0 {
+		return
+	}
+
+	// State written before fetch metadata was recorded is named after the
+	// time it was replaced instead.
+	fetched := time.Now()
+	if st, err := ParseState(data); err == nil && !st.Metadata.FinishedAt.IsZero() {
+		fetched = st.Metadata.FinishedAt
+	}
+
+	if err := os.MkdirAll(GetHistoryPath(), 0755); err != nil {
+		ExitWithError(err)
+	}
+
+	// A snapshot is never replaced: another state of the same second, e.g.
+	// imported right after a fetch, is numbered after the latest snapshot of
+	// that second, and the same state is only kept once.
+	second := fetched.UTC().Truncate(time.Second)
+	name := snapshotPrefix(org) + second.Format(snapshotTimeLayout) + ".json"
+	for _, s := range ListSnapshots(org) {
+		if !s.Time.Equal(second) {
+			continue
+		}
+
+		prev, err := ioutil.ReadFile(s.Path)
+		if err != nil {
+			ExitWithError(err)
+		}
+		if bytes.Equal(prev, data) {
+			return
+		}
+
+		name = fmt.Sprintf("%s%s-%d.json", snapshotPrefix(org), second.Format(snapshotTimeLayout), s.seq+1)
+	}
+
+	if err := WriteFileAtomic(GetHistoryPath(name), data, 0644); err != nil {
+		ExitWithError(err)
+	}
+
+	snapshots := ListSnapshots(org)
+	for len(snapshots) > size {
+		if err := os.Remove(snapshots[0].Path); err != nil {
+			ExitWithError(err)
+		}
+		snapshots = snapshots[1:]
+	}
+}
+
+// ListSnapshots returns the snapshots of the organization, oldest first.
+func ListSnapshots(org string) (snapshots []*Snapshot) {
+	files, err := ioutil.ReadDir(GetHistoryPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		ExitWithError(err)
+	}
+
+	prefix := snapshotPrefix(org)
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+
+		stamp, seq := strings.TrimSuffix(strings.TrimPrefix(name, prefix), ".json"), 1
+		if i := strings.IndexByte(stamp, '-'); i >= 0 {
+			if seq, err = strconv.Atoi(stamp[i+1:]); err != nil || seq < 2 {
+				continue
+			}
+			stamp = stamp[:i]
+		}
+
+		// The snapshots of organization "prod" share the prefix of those
+		// of the organization fetched on the command line, but do not
+		// parse as a time after it.
+		t, err := time.Parse(snapshotTimeLayout, stamp)
+		if err != nil {
+			continue
+		}
+
+		snapshots = append(snapshots, &Snapshot{
+			Name: name,
+			Path: GetHistoryPath(name),
+			Time: t,
+			seq:  seq,
+		})
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool {
+		if !snapshots[i].Time.Equal(snapshots[j].Time) {
+			return snapshots[i].Time.Before(snapshots[j].Time)
+		}
+		return snapshots[i].seq < snapshots[j].seq
+	})
+
+	return
+}
+
+// FindSnapshot returns the path of the snapshot of the organization given by
+// name, with or without the .json extension, or the path of any other state
+// file.
+func FindSnapshot(org, name string) (path string, err error) {
+	for _, s := range ListSnapshots(org) {
+		if name == s.Name || name+".json" == s.Name {
+			return s.Path, nil
+		}
+	}
+
+	if _, err := os.Stat(name); err == nil {
+		return name, nil
+	}
+
+	return "", fmt.Errorf("No snapshot %s in %s", name, GetHistoryPath())
+}
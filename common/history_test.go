@@ -0,0 +1,98 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+// snapshotNames returns the names of the snapshots of the organization,
+// oldest first.
+func snapshotNames(org string) (names []string) {
+	for _, s := range ListSnapshots(org) {
+		names = append(names, s.Name)
+	}
+
+	return
+}
+
+// stateFinishedAt returns a state file fetched at t, with one account.
+func stateFinishedAt(t *testing.T, finished time.Time, id string) []byte {
+	data, err := json.Marshal(&State{
+		Version:  StateVersion,
+		Metadata: StateMetadata{FinishedAt: finished},
+		Accounts: []*Account{{Id: id}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+func TestSnapshotState(t *testing.T) {
+	useHome(t)
+
+	second := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// States fetched in the same second do not replace each other.
+	SnapshotState("", stateFinishedAt(t, second, "111111111111"))
+	SnapshotState("", stateFinishedAt(t, second.Add(500*time.Millisecond), "222222222222"))
+	SnapshotState("", stateFinishedAt(t, second, "333333333333"))
+
+	// The same state is only kept once.
+	SnapshotState("", stateFinishedAt(t, second.Add(500*time.Millisecond), "222222222222"))
+
+	SnapshotState("", stateFinishedAt(t, second.Add(-time.Hour), "444444444444"))
+	SnapshotState("prod", stateFinishedAt(t, second, "555555555555"))
+
+	want := []string{
+		"state-20201231T230000Z.json",
+		"state-20210101T000000Z.json",
+		"state-20210101T000000Z-2.json",
+		"state-20210101T000000Z-3.json",
+	}
+	if got := snapshotNames(""); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("snapshots are %v, want %v", got, want)
+	}
+	for i, id := range []string{"444444444444", "111111111111", "222222222222", "333333333333"} {
+		data, err := ioutil.ReadFile(GetHistoryPath(want[i]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(data), id) {
+			t.Errorf("snapshot %s is not the state of %s:\n%s", want[i], id, data)
+		}
+	}
+	if got := snapshotNames("prod"); strings.Join(got, ",") != "state-prod-20210101T000000Z.json" {
+		t.Errorf("snapshots of prod are %v", got)
+	}
+
+	path, err := FindSnapshot("", "state-20210101T000000Z-2")
+	if err != nil || path != GetHistoryPath(want[2]) {
+		t.Errorf("FindSnapshot returned %q and %v, want %s", path, err, GetHistoryPath(want[2]))
+	}
+}
+
+func TestSnapshotStateHistorySize(t *testing.T) {
+	useHome(t)
+
+	if err := ioutil.WriteFile(GetAPPath(SettingsFilename), []byte(`{"HistorySize": 2}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	second := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 4; i++ {
+		SnapshotState("", stateFinishedAt(t, second, fmt.Sprintf("%012d", i)))
+	}
+
+	// The oldest of the snapshots of the same second are removed first, and
+	// the numbers of those removed are not reused.
+	want := "state-20210101T000000Z-3.json,state-20210101T000000Z-4.json"
+	if got := snapshotNames(""); strings.Join(got, ",") != want {
+		t.Errorf("snapshots are %v, want %s", got, want)
+	}
+}
@@ -0,0 +1,53 @@
+package common
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const LockFilename = "lock"
+
+// Lock takes an advisory lock on the aliased-profiles directory, waiting for
+// any other run holding it to finish, so that two runs, e.g. one from cron
+// and one by hand, cannot interleave their writes to the state and
+// ~/.aws/config. It returns a function that releases the lock. The lock is
+// also released when the process exits.
+func Lock() (unlock func()) {
+	if err := os.MkdirAll(GetAPPath(), 0755); err != nil {
+		ExitWithError(err)
+	}
+
+	path := GetAPPath(LockFilename)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		ExitWithError(err)
+	}
+
+	ok, err := tryLock(f)
+	if err != nil {
+		ExitWithError(err)
+	}
+	if !ok {
+		holder := "another run"
+		if data, err := ioutil.ReadFile(path); err == nil && len(data) != 0 {
+			holder = fmt.Sprintf("process %s", strings.TrimSpace(string(data)))
+		}
+		fmt.Printf("Waiting for %s to release %s\n", holder, path)
+
+		if err := lock(f); err != nil {
+			ExitWithError(err)
+		}
+	}
+
+	// Record who holds the lock for runs waiting on it.
+	if err := f.Truncate(0); err == nil {
+		f.WriteAt([]byte(fmt.Sprintf("%d\n", os.Getpid())), 0)
+	}
+
+	return func() {
+		f.Truncate(0)
+		f.Close()
+	}
+}
@@ -0,0 +1,33 @@
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLock(t *testing.T) {
+	useHome(t)
+
+	unlock := Lock()
+
+	locked := make(chan func())
+	go func() {
+		locked <- Lock()
+	}()
+
+	select {
+	case unlock := <-locked:
+		unlock()
+		t.Fatal("second Lock returned while the first was held")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	unlock()
+
+	select {
+	case unlock := <-locked:
+		unlock()
+	case <-time.After(5 * time.Second):
+		t.Fatal("second Lock did not return once the first was released")
+	}
+}
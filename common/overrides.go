@@ -0,0 +1,150 @@
+package common
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+const OverridesFilename = "overrides.yaml"
+
+var accountIdPattern = regexp.MustCompile(`^[0-9]{12}$`)
+
+// IsAccountId reports whether s is an AWS account ID, i.e. 12 digits.
+func IsAccountId(s string) bool {
+	return accountIdPattern.MatchString(s)
+}
+
+// Override replaces the alias or name of an account, and adds or replaces
+// its tags, before profiles are generated. It is read from OverridesFilename,
+// keyed by account ID, e.g.
+//
+//	"123456789012":
+//	  alias: acme-vendor
+//	  tags:
+//	    environment: production
+type Override struct {
+	Alias string            `yaml:"alias"`
+	Name  string            `yaml:"name"`
+	Tags  map[string]string `yaml:"tags"`
+}
+
+// ReadOverrides returns the overrides in the overrides file by account ID,
+// or none if there is no overrides file.
+func ReadOverrides() (overrides map[string]*Override, err error) {
+	path := GetAPPath(OverridesFilename)
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return
+	}
+
+	if err = yaml.UnmarshalStrict(data, &overrides); err != nil {
+		return nil, fmt.Errorf("Could not parse %s: %v", path, err)
+	}
+
+	var bad []string
+	for id := range overrides {
+		if !IsAccountId(id) {
+			bad = append(bad, fmt.Sprintf("%q", id))
+		}
+	}
+	if len(bad) != 0 {
+		sort.Strings(bad)
+		return nil, fmt.Errorf("Overrides in %s must be keyed by 12 digit account IDs, not %s", path, strings.Join(bad, ", "))
+	}
+
+	return
+}
+
+// ApplyOverrides applies the overrides to the accounts they are keyed by,
+// dropping the name slugs that then collide, and returns the IDs, sorted, of
+// those that match no account.
+func ApplyOverrides(al []*Account, overrides map[string]*Override) (unmatched []string) {
+	matched := make(map[string]bool)
+	for _, a := range al {
+		o, ok := overrides[a.Id]
+		if !ok || o == nil {
+			continue
+		}
+		matched[a.Id] = true
+
+		if o.Alias != "" {
+			a.Alias = o.Alias
+		}
+		if o.Name != "" {
+			a.Name = o.Name
+		}
+
+		keys := make([]string, 0, len(o.Tags))
+		for k := range o.Tags {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			replaced := false
+			for _, t := range a.Tags {
+				if t.Key == k {
+					t.Value, replaced = o.Tags[k], true
+				}
+			}
+			if !replaced {
+				a.Tags = append(a.Tags, &Tag{Key: k, Value: o.Tags[k]})
+			}
+		}
+	}
+
+	DropCollidingNameSlugs(al)
+
+	for id := range overrides {
+		if !matched[id] {
+			unmatched = append(unmatched, id)
+		}
+	}
+	sort.Strings(unmatched)
+
+	return
+}
+
+// CheckOverrideCollisions returns an error naming every profile name that the
+// overrides give to more than one account. Only overrides of the alias or
+// name change profile names; a name shared without them is left to
+// CheckProfileNameCollisions.
+func CheckOverrideCollisions(al []*Account, overrides map[string]*Override) error {
+	byName := make(map[string][]string)
+	for _, a := range al {
+		if name := a.ProfileName(); name != "" {
+			byName[name] = append(byName[name], a.Id)
+		}
+	}
+
+	var collisions []string
+	for name, ids := range byName {
+		overridden := false
+		for _, id := range ids {
+			if o := overrides[id]; o != nil && (o.Alias != "" || o.Name != "") {
+				overridden = true
+			}
+		}
+		if len(ids) > 1 && overridden {
+			collisions = append(collisions, fmt.Sprintf("  %s: %s", name, strings.Join(ids, ", ")))
+		}
+	}
+
+	if len(collisions) == 0 {
+		return nil
+	}
+
+	sort.Strings(collisions)
+
+	return fmt.Errorf("Overrides give several accounts the same profile name:\n%s", strings.Join(collisions, "\n"))
+}
@@ -0,0 +1,265 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+)
+
+// Settings is read from SettingsFilename in the aliased-profiles directory.
+// Every setting is optional.
+type Settings struct {
+	// The organizations fetched when fetch is run without a profile and role.
+	Organizations []*OrganizationSettings
+
+	// The role names to try, in order, in accounts where the fetch role
+	// cannot be assumed or may not read the alias. Used by organizations
+	// without FallbackRoles of their own and when fetch is run with a
+	// profile and role.
+	FallbackRoles []string
+
+	// How the fetch roles are assumed. Used by organizations without
+	// AssumeRole settings of their own and when fetch is run with a profile
+	// and role.
+	AssumeRole AssumeRoleSettings
+
+	// How the roles that may be assumed in each account are discovered.
+	// Used by organizations without RoleDiscovery settings of their own and
+	// when fetch is run with a profile and role.
+	RoleDiscovery RoleDiscoverySettings
+
+	// The number of previous state files kept in the history directory for
+	// each organization, DefaultHistorySize when zero. A negative number
+	// keeps none.
+	HistorySize int
+
+	// Where state files are kept, the aliased-profiles directory by
+	// default.
+	State StateSettings
+}
+
+// StateSettings select the backend the state files of every organization
+// are read from and written to, so that one run may fetch and publish state
+// for others to upsert from.
+type StateSettings struct {
+	// One of "local", the default, "http" or "s3".
+	Backend string
+
+	// The http backend reads each state file from, and writes it to, the URL
+	// formed by appending its name, e.g. state.json, to URL. Headers are sent
+	// with every request, with ${VAR} replaced by environment variables,
+	// e.g. {"Authorization": "Bearer ${STATE_TOKEN}"}.
+	URL     string
+	Headers map[string]string
+
+	// The s3 backend keeps each state file as an object named after it
+	// beneath Prefix in Bucket. Region, Endpoint, for S3-compatible stores,
+	// and Profile, for credentials, are optional. PathStyle addresses the
+	// bucket in the path rather than the host name, which some S3-compatible
+	// stores need.
+	Bucket    string
+	Prefix    string
+	Region    string
+	Endpoint  string
+	Profile   string
+	PathStyle bool
+}
+
+// AssumeRoleSettings configure how the fetch role is assumed in each account
+// and how MFA tokens are obtained for the management profile.
+type AssumeRoleSettings struct {
+	// The external ID required by the trust policy of the fetch role.
+	ExternalId string
+
+	// A text/template for the role session name. The functions user, host and
+	// account return the local user name, the local host name and the ID of
+	// the account the role is assumed in, e.g. "aliased-profiles-{{user}}".
+	SessionName string
+
+	// How long the assumed role credentials are valid for, in seconds.
+	DurationSeconds int
+
+	// A command whose output is the MFA token for the management profile,
+	// e.g. "ykman oath accounts code --single aws". The token is read from
+	// stdin when empty.
+	MFACommand string
+}
+
+// Or returns s with every empty setting taken from o instead.
+func (s AssumeRoleSettings) Or(o AssumeRoleSettings) AssumeRoleSettings {
+	if s.ExternalId == "" {
+		s.ExternalId = o.ExternalId
+	}
+	if s.SessionName == "" {
+		s.SessionName = o.SessionName
+	}
+	if s.DurationSeconds == 0 {
+		s.DurationSeconds = o.DurationSeconds
+	}
+	if s.MFACommand == "" {
+		s.MFACommand = o.MFACommand
+	}
+
+	return s
+}
+
+// RoleDiscoverySettings configure how the roles that may be assumed in each
+// account are discovered. Every role found is probed with AssumeRole and only
+// those that could be assumed are recorded. Discovery is off unless
+// Candidates is set or List is true.
+type RoleDiscoverySettings struct {
+	// Role names, optionally preceded by a path, to look for in every
+	// account, e.g. ["Admin", "ReadOnly"].
+	Candidates []string
+
+	// List the roles of each account with iam:ListRoles, using the fetch
+	// role, in addition to Candidates.
+	List bool
+
+	// Only keep listed roles whose path starts with PathPrefix, e.g.
+	// "/team/", and whose name starts with NamePrefix.
+	PathPrefix string
+	NamePrefix string
+
+	// Only keep listed roles carrying each of these tags, given as "key" or
+	// "key=value". Checking tags costs an iam:ListRoleTags call per role.
+	Tags []string
+}
+
+// Enabled reports whether roles should be discovered.
+func (s RoleDiscoverySettings) Enabled() bool {
+	return len(s.Candidates) != 0 || s.List
+}
+
+// Or returns s, or o when s is not enabled.
+func (s RoleDiscoverySettings) Or(o RoleDiscoverySettings) RoleDiscoverySettings {
+	if s.Enabled() {
+		return s
+	}
+
+	return o
+}
+
+// SSOSettings identify the IAM Identity Center (AWS SSO) portal whose
+// accounts are fetched instead of those of an organization. Either Session,
+// or StartURL and Region, must be set.
+type SSOSettings struct {
+	// The name of an [sso-session] section in ~/.aws/config, as written by
+	// aws configure sso. StartURL and Region are read from it when empty.
+	Session string
+
+	// The start URL of the portal, e.g. https://acme.awsapps.com/start, and
+	// the region it lives in.
+	StartURL string
+	Region   string
+}
+
+// Enabled reports whether accounts should be fetched from the portal.
+func (s SSOSettings) Enabled() bool {
+	return s.Session != "" || s.StartURL != ""
+}
+
+type OrganizationSettings struct {
+	// A short, unique name for the organization. It names the state file of
+	// the organization and is used to select it with fetch --org.
+	Name string
+
+	// The profile from which the accounts of the organization are listed
+	// and the account role is assumed.
+	Profile string
+
+	// The role name to assume in each account to read its alias.
+	Role string
+
+	// The role names to try, in order, after Role.
+	FallbackRoles []string
+
+	// Prepended to the profile name of each account in the organization.
+	ProfilePrefix string
+
+	// How the fetch roles are assumed in the organization. Empty settings
+	// are taken from the top level AssumeRole settings.
+	AssumeRole AssumeRoleSettings
+
+	// How the roles that may be assumed in each account of the organization
+	// are discovered. The top level RoleDiscovery settings are used when
+	// discovery is not enabled here.
+	RoleDiscovery RoleDiscoverySettings
+
+	// The IAM Identity Center portal to fetch the accounts, and the roles
+	// assigned in each, from. Profile and Role are not used when it is set.
+	SSO SSOSettings
+
+	// Whether the accounts of the organization are imported from an
+	// inventory file with import rather than fetched. fetch skips it, and
+	// only Name and ProfilePrefix are used.
+	Import bool
+}
+
+// ReadSettings returns the settings in the settings file, or empty settings
+// if there is no settings file.
+func ReadSettings() *Settings {
+	s := &Settings{}
+
+	data, err := ioutil.ReadFile(GetAPPath(SettingsFilename))
+	if os.IsNotExist(err) {
+		return s
+	}
+	if err != nil {
+		ExitWithError(err)
+	}
+
+	if err := json.Unmarshal(data, s); err != nil {
+		ExitWithError(err)
+	}
+	if err := s.Validate(); err != nil {
+		ExitWithError(fmt.Errorf("Invalid settings in %s: %v", GetAPPath(SettingsFilename), err))
+	}
+
+	return s
+}
+
+// orgNamePattern matches the organization names that are safe to use in the
+// name of a state file.
+var orgNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// Validate checks that every organization has a unique name that can name
+// its state file, and a role to assume in its accounts unless they are
+// fetched through IAM Identity Center or imported.
+func (s *Settings) Validate() error {
+	seen := make(map[string]bool)
+	for i, o := range s.Organizations {
+		if o == nil {
+			return fmt.Errorf("organization %d is empty", i+1)
+		}
+		if o.Name == "" {
+			return fmt.Errorf("organization %d has no Name", i+1)
+		}
+		if !orgNamePattern.MatchString(o.Name) {
+			return fmt.Errorf("organization %d is named %q, but names may only contain letters, digits, '.', '-' and '_' and must start with a letter or digit", i+1, o.Name)
+		}
+		if seen[o.Name] {
+			return fmt.Errorf("organization %d is named %s, like an earlier organization", i+1, o.Name)
+		}
+		seen[o.Name] = true
+
+		if o.Role == "" && !o.SSO.Enabled() && !o.Import {
+			return fmt.Errorf("organization %s has no Role to assume in its accounts", o.Name)
+		}
+	}
+
+	return nil
+}
+
+// AccountRoles returns the role names to try assuming, in order, in each
+// account of the organization.
+func (o *OrganizationSettings) AccountRoles(s *Settings) []string {
+	fallbacks := o.FallbackRoles
+	if len(fallbacks) == 0 {
+		fallbacks = s.FallbackRoles
+	}
+
+	return append([]string{o.Role}, fallbacks...)
+}
@@ -0,0 +1,71 @@
+package common
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSettingsValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		orgs []*OrganizationSettings
+		err  string
+	}{
+		{
+			name: "no organizations",
+		},
+		{
+			name: "fetched, SSO and imported organizations",
+			orgs: []*OrganizationSettings{
+				{Name: "commercial", Profile: "default", Role: "Production"},
+				{Name: "sso.acme", SSO: SSOSettings{StartURL: "https://acme.awsapps.com/start", Region: "us-east-1"}},
+				{Name: "partner_1", Import: true},
+			},
+		},
+		{
+			name: "empty name",
+			orgs: []*OrganizationSettings{{Name: "commercial", Role: "Production"}, {Role: "Production"}},
+			err:  "organization 2 has no Name",
+		},
+		{
+			name: "duplicate name",
+			orgs: []*OrganizationSettings{{Name: "acme", Role: "Production"}, {Name: "acme", Role: "ReadOnly"}},
+			err:  "organization 2 is named acme, like an earlier organization",
+		},
+		{
+			name: "name with a slash",
+			orgs: []*OrganizationSettings{{Name: "../../config", Role: "Production"}},
+			err:  `organization 1 is named "../../config"`,
+		},
+		{
+			name: "dot dot",
+			orgs: []*OrganizationSettings{{Name: "..", Role: "Production"}},
+			err:  `organization 1 is named ".."`,
+		},
+		{
+			name: "no role",
+			orgs: []*OrganizationSettings{{Name: "commercial", Profile: "default"}},
+			err:  "organization commercial has no Role",
+		},
+		{
+			name: "null organization",
+			orgs: []*OrganizationSettings{nil},
+			err:  "organization 1 is empty",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := (&Settings{Organizations: tt.orgs}).Validate()
+			if tt.err == "" {
+				if err != nil {
+					t.Errorf("Validate returned %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("Validate returned %v, want an error containing %q", err, tt.err)
+			}
+		})
+	}
+}
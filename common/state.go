@@ -0,0 +1,401 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// GetStateName returns the name of the state file of the organization with
+// the given name in the settings file. The organization fetched with a
+// profile and role on the command line has no name and uses StateFilename.
+func GetStateName(org string) string {
+	if org == "" {
+		return StateFilename
+	}
+
+	return fmt.Sprintf("state-%s.json", org)
+}
+
+// GetStatePath returns where the state file of the organization is stored,
+// a path for the local backend and e.g. a URL for the others.
+func GetStatePath(org string) string {
+	return GetStateBackend().Location(GetStateName(org))
+}
+
+// StateVersion is the schema version of the state files written by this
+// version of the tool. Version 1 state files are a bare array of accounts.
+const StateVersion = 2
+
+// State is the contents of a state file: the accounts of an organization,
+// sorted by ID, and how they were fetched.
+type State struct {
+	Version  int
+	Metadata StateMetadata
+	Accounts []*Account
+}
+
+// StateMetadata describes the fetch that wrote a state file.
+type StateMetadata struct {
+	// The version of aws-aliased-profiles that wrote the state.
+	ToolVersion string
+
+	// The profile the accounts were listed with, empty when they were
+	// fetched through IAM Identity Center or from a file.
+	ManagementProfile string
+
+	StartedAt  time.Time
+	FinishedAt time.Time
+
+	// The ID of the organization, e.g. o-a1b2c3d4e5, if known.
+	OrganizationId string
+
+	// The inventory file the accounts were imported from, empty when they
+	// were fetched.
+	ImportedFrom string `json:",omitempty"`
+}
+
+// Imported reports whether the accounts were imported from an inventory
+// file rather than fetched.
+func (m StateMetadata) Imported() bool {
+	return m.ImportedFrom != ""
+}
+
+// WriteAccountList writes the accounts of the organization to its state file
+// along with the metadata of the fetch. Accounts are sorted by ID, and their
+// tags by key, so that fetching the same organization twice gives a file that
+// only differs where the organization changed.
+func WriteAccountList(org string, al []*Account, meta StateMetadata) {
+	meta.ToolVersion = Version
+
+	al = append([]*Account(nil), al...)
+	sort.Slice(al, func(i, j int) bool { return al[i].Id < al[j].Id })
+	for _, a := range al {
+		sortTags(a.Tags)
+		for _, ou := range a.OUs {
+			sortTags(ou.Tags)
+		}
+	}
+
+	data, err := json.MarshalIndent(&State{
+		Version:  StateVersion,
+		Metadata: meta,
+		Accounts: al,
+	}, "", "    ")
+	if err != nil {
+		ExitWithError(err)
+	}
+
+	b := GetStateBackend()
+	name := GetStateName(org)
+
+	prev, err := b.Read(name)
+	if err == nil {
+		SnapshotState(org, prev)
+	} else if !os.IsNotExist(err) {
+		ExitWithError(err)
+	}
+
+	if err := b.Write(name, append(data, '\n')); err != nil {
+		ExitWithError(err)
+	}
+}
+
+func sortTags(tags []*Tag) {
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].Key < tags[j].Key })
+}
+
+// ReadState returns the state file of a single organization, migrated to
+// StateVersion.
+func ReadState(org string) (st *State) {
+	if st = ReadStateIfExists(org); st == nil {
+		ExitWithError(notExist(GetStatePath(org)))
+	}
+
+	return
+}
+
+// ReadStateIfExists returns the state file of a single organization, migrated
+// to StateVersion, or nil if none has been written yet.
+func ReadStateIfExists(org string) (st *State) {
+	data, err := GetStateBackend().Read(GetStateName(org))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		ExitWithError(err)
+	}
+
+	if st, err = ParseState(data); err != nil {
+		ExitWithError(fmt.Errorf("Could not parse %s: %v", GetStatePath(org), err))
+	}
+
+	for _, a := range st.Accounts {
+		// State written before organizations were recorded has none.
+		if a.Org == nil {
+			a.Org = &Organization{Name: org}
+		}
+	}
+
+	return
+}
+
+// ReadStateFile returns the local state file, or snapshot of one, at path
+// migrated to StateVersion.
+func ReadStateFile(path string) (st *State, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+
+	if st, err = ParseState(data); err != nil {
+		return nil, fmt.Errorf("Could not parse %s: %v", path, err)
+	}
+
+	return
+}
+
+// ParseAccountList parses the accounts in the contents of a state file of any
+// version.
+func ParseAccountList(data []byte) (al []*Account, err error) {
+	st, err := ParseState(data)
+	if err != nil {
+		return
+	}
+
+	return st.Accounts, nil
+}
+
+// ParseState parses the contents of a state file of any version up to
+// StateVersion and migrates it to StateVersion.
+func ParseState(data []byte) (st *State, err error) {
+	st = &State{}
+
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) != 0 && trimmed[0] == '[' {
+		st.Version = 1
+		err = json.Unmarshal(trimmed, &st.Accounts)
+	} else {
+		err = json.Unmarshal(trimmed, st)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if st.Version < 1 {
+		return nil, fmt.Errorf("State has no schema version")
+	}
+	if st.Version > StateVersion {
+		return nil, fmt.Errorf("State has schema version %d, but this version of aws-aliased-profiles only reads up to %d, please upgrade", st.Version, StateVersion)
+	}
+
+	// Version 2 only wrapped the accounts of version 1 in an envelope with
+	// metadata, which version 1 did not record, so reading the bare array
+	// above is the whole migration.
+	st.Version = StateVersion
+
+	return st, nil
+}
+
+// ReadAccountList returns the accounts of every organization with a state
+// file: the one fetched with a profile and role on the command line and each
+// one in the settings file, with the overrides file applied and colliding
+// name slugs dropped, as profiles are generated for them. It also returns the
+// IDs of the overrides that match no account. It exits if an override gives
+// an account the profile name of another, or if accounts from different
+// organizations would get the same profile name.
+func ReadAccountList() (al []*Account, unmatched []string) {
+	orgs := []string{""}
+	for _, o := range ReadSettings().Organizations {
+		orgs = append(orgs, o.Name)
+	}
+
+	found := false
+	for _, org := range orgs {
+		if st := ReadStateIfExists(org); st != nil {
+			found = true
+			al = append(al, st.Accounts...)
+		}
+	}
+
+	if !found {
+		ExitWithError(fmt.Errorf("No state found at %s, please run 'aws-aliased-profiles fetch' first", GetStatePath("")))
+	}
+
+	overrides, err := ReadOverrides()
+	if err != nil {
+		ExitWithError(err)
+	}
+	unmatched = ApplyOverrides(al, overrides)
+
+	// Aliases overridden to tell accounts apart may resolve collisions
+	// across organizations, so those are only checked afterwards.
+	if err := CheckOverrideCollisions(al, overrides); err != nil {
+		ExitWithError(err)
+	}
+	if err := CheckProfileNameCollisions(al); err != nil {
+		ExitWithError(err)
+	}
+
+	return
+}
+
+// DropCollidingNameSlugs leaves the name slug out of the profile name of each
+// account without an alias whose slug is also the profile name or ID of
+// another account in the same organization. Unlike aliases, account names
+// need not be unique, e.g. several accounts may be named "Sandbox". It
+// returns the accounts whose name slug is left out, and may be called again
+// after aliases or names change.
+func DropCollidingNameSlugs(al []*Account) (dropped []*Account) {
+	type orgName struct {
+		org  string
+		name string
+	}
+	label := func(a *Account) string {
+		if a.Org == nil {
+			return ""
+		}
+		return a.Org.Label()
+	}
+
+	byName := make(map[orgName][]*Account)
+	for _, a := range al {
+		a.nameSlugDropped = false
+		for _, name := range []string{a.Id, a.ProfileName()} {
+			if name != "" {
+				key := orgName{label(a), name}
+				byName[key] = append(byName[key], a)
+			}
+		}
+	}
+
+	for _, a := range al {
+		if a.Alias != "" || a.NameSlug() == "" {
+			continue
+		}
+		for _, other := range byName[orgName{label(a), a.ProfileName()}] {
+			if other != a {
+				dropped = append(dropped, a)
+				break
+			}
+		}
+	}
+
+	// Only drop them once every collision is known, since dropping a slug
+	// changes the profile name it is looked up by.
+	for _, a := range dropped {
+		a.nameSlugDropped = true
+	}
+
+	return
+}
+
+// CheckProfileNameCollisions returns an error naming every profile name
+// shared by accounts from different organizations, or by the same account
+// fetched from more than one organization.
+func CheckProfileNameCollisions(al []*Account) error {
+	byName := make(map[string][]*Account)
+	for _, a := range al {
+		for _, name := range []string{a.Id, a.ProfileName()} {
+			if name != "" {
+				byName[name] = append(byName[name], a)
+			}
+		}
+	}
+
+	var collisions []string
+	for name, accounts := range byName {
+		if !fromSeveralOrganizations(accounts) {
+			continue
+		}
+
+		var where []string
+		for _, a := range accounts {
+			where = append(where, fmt.Sprintf("%s in %s", a.Id, a.Org.Label()))
+		}
+		collisions = append(collisions, fmt.Sprintf("  %s: %s", name, strings.Join(where, ", ")))
+	}
+
+	if len(collisions) == 0 {
+		return nil
+	}
+
+	sort.Strings(collisions)
+
+	return fmt.Errorf(
+		"Profile names collide across organizations, consider setting a ProfilePrefix:\n%s",
+		strings.Join(collisions, "\n"),
+	)
+}
+
+func fromSeveralOrganizations(al []*Account) bool {
+	for _, a := range al[1:] {
+		if a.Org.Label() != al[0].Org.Label() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Checkpoint holds the accounts completed so far by an interrupted fetch.
+type Checkpoint struct {
+	// When the fetch that wrote the checkpoint first started. Attributes
+	// fetched since then are not fetched again when resuming.
+	StartedAt time.Time
+
+	Accounts []*Account
+}
+
+// GetCheckpointPath returns the path of the checkpoint of the organization
+// with the given name in the settings file.
+func GetCheckpointPath(org string) string {
+	if org == "" {
+		return GetAPPath("progress.json")
+	}
+
+	return GetAPPath(fmt.Sprintf("progress-%s.json", org))
+}
+
+func WriteCheckpoint(org string, cp *Checkpoint) {
+	data, err := json.MarshalIndent(cp, "", "    ")
+	if err != nil {
+		ExitWithError(err)
+	}
+
+	if err := WriteFileAtomic(GetCheckpointPath(org), data, 0644); err != nil {
+		ExitWithError(err)
+	}
+}
+
+// ReadCheckpoint returns the checkpoint of the organization, or nil if there
+// is none.
+func ReadCheckpoint(org string) *Checkpoint {
+	data, err := ioutil.ReadFile(GetCheckpointPath(org))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		ExitWithError(err)
+	}
+
+	cp := &Checkpoint{}
+	if err := json.Unmarshal(data, cp); err != nil {
+		ExitWithError(err)
+	}
+
+	return cp
+}
+
+// RemoveCheckpoint removes the checkpoint of the organization, if any.
+func RemoveCheckpoint(org string) {
+	err := os.Remove(GetCheckpointPath(org))
+	if err != nil && !os.IsNotExist(err) {
+		ExitWithError(err)
+	}
+}
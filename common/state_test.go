@@ -0,0 +1,240 @@
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// useHome points HOME at a new, empty home directory until the end of the
+// test, as the state is read from and written to ~/.aws/aliased-profiles.
+func useHome(t testing.TB) string {
+	t.Helper()
+
+	home, err := ioutil.TempDir("", "common-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(home, ".aws", DirName), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	setenv(t, "HOME", home)
+	t.Cleanup(func() { os.RemoveAll(home) })
+
+	return home
+}
+
+func TestParseState(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		accounts []string
+		profile  string
+		err      string
+	}{
+		{
+			name:     "version 1 array",
+			data:     `[{"Id": "222222222222", "Alias": "b"}, {"Id": "111111111111", "Alias": "a"}]`,
+			accounts: []string{"222222222222", "111111111111"},
+		},
+		{
+			name:     "version 1 empty array",
+			data:     " []\n",
+			accounts: []string{},
+		},
+		{
+			name: "version 2 envelope",
+			data: `{
+				"Version": 2,
+				"Metadata": {"ManagementProfile": "default"},
+				"Accounts": [{"Id": "111111111111", "Alias": "a"}]
+			}`,
+			accounts: []string{"111111111111"},
+			profile:  "default",
+		},
+		{
+			name: "missing version",
+			data: `{"Accounts": [{"Id": "111111111111"}]}`,
+			err:  "no schema version",
+		},
+		{
+			name: "newer version",
+			data: `{"Version": 3, "Accounts": []}`,
+			err:  "schema version 3",
+		},
+		{
+			name: "not JSON",
+			data: `state`,
+			err:  "invalid character",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st, err := ParseState([]byte(tt.data))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("ParseState returned %v, want an error containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if st.Version != StateVersion {
+				t.Errorf("Version is %d, want %d", st.Version, StateVersion)
+			}
+			if st.Metadata.ManagementProfile != tt.profile {
+				t.Errorf("ManagementProfile is %q, want %q", st.Metadata.ManagementProfile, tt.profile)
+			}
+
+			ids := make([]string, 0, len(st.Accounts))
+			for _, a := range st.Accounts {
+				ids = append(ids, a.Id)
+			}
+			if strings.Join(ids, ",") != strings.Join(tt.accounts, ",") {
+				t.Errorf("accounts are %v, want %v", ids, tt.accounts)
+			}
+		})
+	}
+}
+
+func TestWriteAccountList(t *testing.T) {
+	useHome(t)
+
+	org := &Organization{Id: "o-ab12"}
+	ou := &OrganizationalUnit{Id: "r-ab12", Name: "Root", Tags: []*Tag{{Key: "z", Value: "1"}, {Key: "a", Value: "2"}}}
+	WriteAccountList("", []*Account{
+		{Id: "333333333333", Org: org, Tags: []*Tag{{Key: "team", Value: "c"}, {Key: "environment", Value: "prod"}}, OUs: []*OrganizationalUnit{ou}},
+		{Id: "111111111111", Org: org},
+		{Id: "222222222222", Org: org, Tags: []*Tag{{Key: "b", Value: "2"}, {Key: "a", Value: "1"}}},
+	}, StateMetadata{ManagementProfile: "default"})
+
+	data, err := ioutil.ReadFile(GetAPPath(StateFilename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), "{") {
+		t.Fatalf("state is not an envelope:\n%s", data)
+	}
+
+	st := ReadState("")
+	if st.Version != StateVersion || st.Metadata.ManagementProfile != "default" || st.Metadata.ToolVersion != Version {
+		t.Errorf("state has version %d and metadata %+v", st.Version, st.Metadata)
+	}
+
+	var ids []string
+	for _, a := range st.Accounts {
+		ids = append(ids, a.Id)
+		for i := 1; i < len(a.Tags); i++ {
+			if a.Tags[i-1].Key > a.Tags[i].Key {
+				t.Errorf("tags of %s are not sorted by key: %s before %s", a.Id, a.Tags[i-1].Key, a.Tags[i].Key)
+			}
+		}
+		for _, o := range a.OUs {
+			if len(o.Tags) != 2 || o.Tags[0].Key != "a" {
+				t.Errorf("tags of %s in %s are not sorted by key", o.Id, a.Id)
+			}
+		}
+	}
+	if got := strings.Join(ids, ","); got != "111111111111,222222222222,333333333333" {
+		t.Errorf("accounts are in the order %s, want sorted by ID", got)
+	}
+
+	// Writing the same accounts again gives the same file.
+	WriteAccountList("", st.Accounts, st.Metadata)
+	again, err := ioutil.ReadFile(GetAPPath(StateFilename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(again) != string(data) {
+		t.Errorf("rewriting the state changed it from\n%s\nto\n%s", data, again)
+	}
+}
+
+// readAccountList calls ReadAccountList, returning the error it exits with.
+func readAccountList() (al []*Account, unmatched []string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = r.(error)
+		}
+	}()
+
+	al, unmatched = ReadAccountList()
+
+	return
+}
+
+func TestReadAccountListOverrides(t *testing.T) {
+	home := useHome(t)
+
+	settings := `{"Organizations": [{"Name": "commercial", "Role": "Fetch"}, {"Name": "acquired", "Role": "Fetch"}]}`
+	if err := ioutil.WriteFile(GetAPPath(SettingsFilename), []byte(settings), 0644); err != nil {
+		t.Fatal(err)
+	}
+	WriteAccountList("commercial", []*Account{
+		{Id: "111111111111", Alias: "shared", Org: &Organization{Name: "commercial"}},
+	}, StateMetadata{})
+	WriteAccountList("acquired", []*Account{
+		{Id: "222222222222", Alias: "shared", Org: &Organization{Name: "acquired"}},
+	}, StateMetadata{})
+
+	if _, _, err := readAccountList(); err == nil || !strings.Contains(err.Error(), "collide across organizations") {
+		t.Fatalf("ReadAccountList returned %v, want a collision across organizations", err)
+	}
+
+	// An override of the tags alone leaves the collision across
+	// organizations as it was.
+	overrides := filepath.Join(home, ".aws", DirName, OverridesFilename)
+	err := ioutil.WriteFile(overrides, []byte(`
+"222222222222":
+  tags:
+    environment: production
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := readAccountList(); err == nil || !strings.Contains(err.Error(), "collide across organizations") {
+		t.Fatalf("ReadAccountList returned %v, want a collision across organizations", err)
+	}
+
+	// An override of the alias tells the accounts apart.
+	err = ioutil.WriteFile(overrides, []byte(`
+"222222222222":
+  alias: acquired-shared
+"333333333333":
+  alias: gone
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	al, unmatched, err := readAccountList()
+	if err != nil {
+		t.Fatalf("ReadAccountList returned %v", err)
+	}
+	if strings.Join(unmatched, ",") != "333333333333" {
+		t.Errorf("unmatched overrides are %v, want 333333333333", unmatched)
+	}
+	for _, a := range al {
+		if a.Id == "222222222222" && a.ProfileName() != "acquired-shared" {
+			t.Errorf("profile name of %s is %q, want acquired-shared", a.Id, a.ProfileName())
+		}
+	}
+
+	// An override may not give an account the profile name of another.
+	err = ioutil.WriteFile(overrides, []byte(`
+"222222222222":
+  alias: shared
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := readAccountList(); err == nil || !strings.Contains(err.Error(), "Overrides give several accounts the same profile name") {
+		t.Errorf("ReadAccountList returned %v, want an override collision", err)
+	}
+}
@@ -9,6 +9,16 @@ import (
 )
 
 func InitProfileTemplate() {
+	writeProfileTemplate(common.DefaultProfileTemplate)
+}
+
+// InitSSOProfileTemplate places the default template for accounts fetched
+// from IAM Identity Center, which adds an SSO profile per account and role.
+func InitSSOProfileTemplate() {
+	writeProfileTemplate(common.DefaultSSOProfileTemplate)
+}
+
+func writeProfileTemplate(tmpl string) {
 	dirPath := common.GetAPPath()
 	if _, err := os.Stat(dirPath); os.IsNotExist(err) {
 		err = os.Mkdir(dirPath, 0755)
@@ -17,7 +27,7 @@ func InitProfileTemplate() {
 
 	path := common.GetAPPath(common.ConfigFilename)
 
-	err := ioutil.WriteFile(path, []byte(common.DefaultProfileTemplate), 0644)
+	err := ioutil.WriteFile(path, []byte(tmpl), 0644)
 	if err != nil {
 		common.ExitWithError(err)
 	}
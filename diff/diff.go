@@ -0,0 +1,318 @@
+package diff
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+
+	"github.com/logston/aws-aliased-profiles/common"
+)
+
+// Diff holds the changes to the accounts of an organization between two
+// state files.
+type Diff struct {
+	// The names of the state files compared.
+	From string
+	To   string
+
+	Added   []*AccountRef
+	Removed []*AccountRef
+
+	// Accounts whose status became SUSPENDED, and whose status changed in
+	// any other way.
+	Suspended     []*Change
+	StatusChanged []*Change
+
+	Realiased   []*Change
+	Renamed     []*Change
+	TagsChanged []*TagsChange
+}
+
+// AccountRef identifies an account added or removed.
+type AccountRef struct {
+	Id     string
+	Alias  string
+	Name   string
+	Status string
+}
+
+// Change is a change to a single attribute of an account.
+type Change struct {
+	Id    string
+	Alias string
+	From  string
+	To    string
+}
+
+// TagsChange lists the tags added to, removed from and changed on an
+// account.
+type TagsChange struct {
+	Id      string
+	Alias   string
+	Added   []*common.Tag
+	Removed []*common.Tag
+	Changed []*TagChange
+}
+
+// TagChange is a change to the value of a tag.
+type TagChange struct {
+	Key  string
+	From string
+	To   string
+}
+
+// Empty reports whether nothing changed.
+func (d *Diff) Empty() bool {
+	return len(d.Added) == 0 &&
+		len(d.Removed) == 0 &&
+		len(d.Suspended) == 0 &&
+		len(d.StatusChanged) == 0 &&
+		len(d.Realiased) == 0 &&
+		len(d.Renamed) == 0 &&
+		len(d.TagsChanged) == 0
+}
+
+// States compares two state files of the organization. Each of names is a
+// snapshot in the history directory or the path of a state file. With a
+// single name, the snapshot is compared with the current state, and without
+// any, the latest snapshot is.
+func States(org string, names []string) (d *Diff, err error) {
+	paths := make([]string, 0, 2)
+	for _, name := range names {
+		var path string
+		if path, err = common.FindSnapshot(org, name); err != nil {
+			return
+		}
+		paths = append(paths, path)
+	}
+
+	if len(paths) == 0 {
+		snapshots := common.ListSnapshots(org)
+		if len(snapshots) == 0 {
+			return nil, fmt.Errorf("No snapshots in %s yet, one is kept each time fetch replaces %s", common.GetHistoryPath(), common.GetStatePath(org))
+		}
+		paths = append(paths, snapshots[len(snapshots)-1].Path)
+	}
+
+	from, err := common.ReadStateFile(paths[0])
+	if err != nil {
+		return
+	}
+
+	// The current state may be kept by a remote backend.
+	var to *common.State
+	toName := common.GetStateName(org)
+	if len(paths) == 2 {
+		if to, err = common.ReadStateFile(paths[1]); err != nil {
+			return
+		}
+		toName = filepath.Base(paths[1])
+	} else {
+		to = common.ReadState(org)
+	}
+
+	d = Compare(from.Accounts, to.Accounts)
+	d.From = filepath.Base(paths[0])
+	d.To = toName
+
+	return
+}
+
+// Compare returns the changes from the accounts in from to those in to. The
+// alias or tags of an account are only compared when they were fetched in
+// both, so that a failed fetch is not reported as the alias or tags being
+// removed.
+func Compare(from, to []*common.Account) *Diff {
+	d := &Diff{
+		Added:         []*AccountRef{},
+		Removed:       []*AccountRef{},
+		Suspended:     []*Change{},
+		StatusChanged: []*Change{},
+		Realiased:     []*Change{},
+		Renamed:       []*Change{},
+		TagsChanged:   []*TagsChange{},
+	}
+
+	before := byId(from)
+	after := byId(to)
+
+	for _, id := range sortedIds(after) {
+		b, a := before[id], after[id]
+		if b == nil {
+			d.Added = append(d.Added, ref(a))
+			continue
+		}
+
+		if a.Status != b.Status {
+			c := &Change{Id: id, Alias: a.Alias, From: b.Status, To: a.Status}
+			if a.Status == "SUSPENDED" {
+				d.Suspended = append(d.Suspended, c)
+			} else {
+				d.StatusChanged = append(d.StatusChanged, c)
+			}
+		}
+
+		if fetched(b.FetchOutcome.Alias) && fetched(a.FetchOutcome.Alias) && a.Alias != b.Alias {
+			d.Realiased = append(d.Realiased, &Change{Id: id, Alias: a.Alias, From: b.Alias, To: a.Alias})
+		}
+
+		if a.Name != b.Name {
+			d.Renamed = append(d.Renamed, &Change{Id: id, Alias: a.Alias, From: b.Name, To: a.Name})
+		}
+
+		if fetched(b.FetchOutcome.Tags) && fetched(a.FetchOutcome.Tags) {
+			if tc := compareTags(b.Tags, a.Tags); tc != nil {
+				tc.Id, tc.Alias = id, a.Alias
+				d.TagsChanged = append(d.TagsChanged, tc)
+			}
+		}
+	}
+
+	for _, id := range sortedIds(before) {
+		if after[id] == nil {
+			d.Removed = append(d.Removed, ref(before[id]))
+		}
+	}
+
+	return d
+}
+
+// fetched reports whether an attribute was fetched. State written before
+// outcomes were recorded has no status.
+func fetched(o common.FetchOutcome) bool {
+	return o.Status == "" || o.Status == common.FetchOK
+}
+
+func byId(al []*common.Account) map[string]*common.Account {
+	m := make(map[string]*common.Account, len(al))
+	for _, a := range al {
+		m[a.Id] = a
+	}
+
+	return m
+}
+
+func sortedIds(m map[string]*common.Account) []string {
+	ids := make([]string, 0, len(m))
+	for id := range m {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	return ids
+}
+
+func ref(a *common.Account) *AccountRef {
+	return &AccountRef{Id: a.Id, Alias: a.Alias, Name: a.Name, Status: a.Status}
+}
+
+// compareTags returns the changes from the tags in from to those in to, or
+// nil if there are none.
+func compareTags(from, to []*common.Tag) *TagsChange {
+	before := make(map[string]string)
+	for _, t := range from {
+		before[t.Key] = t.Value
+	}
+	after := make(map[string]string)
+	for _, t := range to {
+		after[t.Key] = t.Value
+	}
+
+	tc := &TagsChange{}
+	for _, k := range sortedKeys(after) {
+		v, ok := before[k]
+		if !ok {
+			tc.Added = append(tc.Added, &common.Tag{Key: k, Value: after[k]})
+		} else if v != after[k] {
+			tc.Changed = append(tc.Changed, &TagChange{Key: k, From: v, To: after[k]})
+		}
+	}
+	for _, k := range sortedKeys(before) {
+		if _, ok := after[k]; !ok {
+			tc.Removed = append(tc.Removed, &common.Tag{Key: k, Value: before[k]})
+		}
+	}
+
+	if len(tc.Added) == 0 && len(tc.Removed) == 0 && len(tc.Changed) == 0 {
+		return nil
+	}
+
+	return tc
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// Print writes the changes in d for people to read.
+func Print(w io.Writer, d *Diff) {
+	fmt.Fprintf(w, "Comparing %s with %s\n", d.From, d.To)
+
+	if d.Empty() {
+		fmt.Fprintln(w, "\nNo changes")
+		return
+	}
+
+	printRefs(w, "Added", "+", d.Added)
+	printRefs(w, "Removed", "-", d.Removed)
+	printChanges(w, "Suspended", d.Suspended)
+	printChanges(w, "Status changed", d.StatusChanged)
+	printChanges(w, "Re-aliased", d.Realiased)
+	printChanges(w, "Renamed", d.Renamed)
+
+	if len(d.TagsChanged) != 0 {
+		fmt.Fprintf(w, "\nTags changed (%d):\n", len(d.TagsChanged))
+		for _, tc := range d.TagsChanged {
+			fmt.Fprintf(w, "  %s  %s\n", tc.Id, tc.Alias)
+			for _, t := range tc.Added {
+				fmt.Fprintf(w, "      + %s=%s\n", t.Key, t.Value)
+			}
+			for _, t := range tc.Removed {
+				fmt.Fprintf(w, "      - %s=%s\n", t.Key, t.Value)
+			}
+			for _, t := range tc.Changed {
+				fmt.Fprintf(w, "      ~ %s=%s -> %s\n", t.Key, t.From, t.To)
+			}
+		}
+	}
+}
+
+func printRefs(w io.Writer, heading, sign string, refs []*AccountRef) {
+	if len(refs) == 0 {
+		return
+	}
+
+	fmt.Fprintf(w, "\n%s (%d):\n", heading, len(refs))
+	for _, r := range refs {
+		fmt.Fprintf(w, "  %s %s  %-24s %s\n", sign, r.Id, r.Alias, r.Name)
+	}
+}
+
+func printChanges(w io.Writer, heading string, changes []*Change) {
+	if len(changes) == 0 {
+		return
+	}
+
+	fmt.Fprintf(w, "\n%s (%d):\n", heading, len(changes))
+	for _, c := range changes {
+		fmt.Fprintf(w, "  %s  %-24s %q -> %q\n", c.Id, c.Alias, c.From, c.To)
+	}
+}
+
+// PrintJSON writes d as indented JSON.
+func PrintJSON(w io.Writer, d *Diff) {
+	data, err := json.MarshalIndent(d, "", "    ")
+	if err != nil {
+		common.ExitWithError(err)
+	}
+
+	fmt.Fprintln(w, string(data))
+}
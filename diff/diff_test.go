@@ -0,0 +1,172 @@
+package diff
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/logston/aws-aliased-profiles/common"
+)
+
+var (
+	ok     = common.FetchOutcome{Status: common.FetchOK}
+	denied = common.FetchOutcome{Status: common.FetchAssumeRoleDenied, Error: "AccessDenied"}
+)
+
+// account returns an active account whose alias and tags were fetched.
+func account(id, alias string, tags ...string) *common.Account {
+	a := &common.Account{
+		Id:           id,
+		Alias:        alias,
+		Name:         "Account " + id[:1],
+		Status:       "ACTIVE",
+		FetchOutcome: common.FetchOutcomes{Alias: ok, Tags: ok},
+	}
+	for _, t := range tags {
+		kv := strings.SplitN(t, "=", 2)
+		a.Tags = append(a.Tags, &common.Tag{Key: kv[0], Value: kv[1]})
+	}
+
+	return a
+}
+
+// summarize returns a line for each change in d.
+func summarize(d *Diff) (lines []string) {
+	for _, r := range d.Added {
+		lines = append(lines, "added "+r.Id)
+	}
+	for _, r := range d.Removed {
+		lines = append(lines, "removed "+r.Id)
+	}
+	for _, kind := range []struct {
+		name    string
+		changes []*Change
+	}{
+		{"suspended", d.Suspended},
+		{"status", d.StatusChanged},
+		{"realiased", d.Realiased},
+		{"renamed", d.Renamed},
+	} {
+		for _, c := range kind.changes {
+			lines = append(lines, fmt.Sprintf("%s %s %s->%s", kind.name, c.Id, c.From, c.To))
+		}
+	}
+	for _, tc := range d.TagsChanged {
+		var parts []string
+		for _, t := range tc.Added {
+			parts = append(parts, "+"+t.Key+"="+t.Value)
+		}
+		for _, t := range tc.Removed {
+			parts = append(parts, "-"+t.Key+"="+t.Value)
+		}
+		for _, t := range tc.Changed {
+			parts = append(parts, "~"+t.Key+"="+t.From+"->"+t.To)
+		}
+		lines = append(lines, fmt.Sprintf("tags %s %s", tc.Id, strings.Join(parts, " ")))
+	}
+
+	return
+}
+
+func TestCompare(t *testing.T) {
+	tests := []struct {
+		name string
+		from []*common.Account
+		to   []*common.Account
+
+		// Changes the to accounts before comparing.
+		change func(to []*common.Account)
+
+		want []string
+	}{
+		{
+			name: "unchanged",
+			from: []*common.Account{account("111111111111", "a", "env=prod")},
+			to:   []*common.Account{account("111111111111", "a", "env=prod")},
+		},
+		{
+			name: "added and removed",
+			from: []*common.Account{account("111111111111", "a"), account("222222222222", "b")},
+			to:   []*common.Account{account("333333333333", "c"), account("111111111111", "a")},
+			want: []string{"added 333333333333", "removed 222222222222"},
+		},
+		{
+			name: "suspended",
+			from: []*common.Account{account("111111111111", "a")},
+			to:   []*common.Account{account("111111111111", "a")},
+			change: func(to []*common.Account) {
+				to[0].Status = "SUSPENDED"
+			},
+			want: []string{"suspended 111111111111 ACTIVE->SUSPENDED"},
+		},
+		{
+			name: "other status change",
+			from: []*common.Account{account("111111111111", "a")},
+			to:   []*common.Account{account("111111111111", "a")},
+			change: func(to []*common.Account) {
+				to[0].Status = "PENDING_CLOSURE"
+			},
+			want: []string{"status 111111111111 ACTIVE->PENDING_CLOSURE"},
+		},
+		{
+			name: "re-aliased and renamed",
+			from: []*common.Account{account("111111111111", "a")},
+			to:   []*common.Account{account("111111111111", "acme-a")},
+			change: func(to []*common.Account) {
+				to[0].Name = "Acme A"
+			},
+			want: []string{"realiased 111111111111 a->acme-a", "renamed 111111111111 Account 1->Acme A"},
+		},
+		{
+			name: "tags added, removed and changed",
+			from: []*common.Account{account("111111111111", "a", "env=dev", "team=x")},
+			to:   []*common.Account{account("111111111111", "a", "env=prod", "cost-center=42")},
+			want: []string{"tags 111111111111 +cost-center=42 -team=x ~env=dev->prod"},
+		},
+		{
+			name: "failed alias fetch is not a removed alias",
+			from: []*common.Account{account("111111111111", "a")},
+			to:   []*common.Account{account("111111111111", "")},
+			change: func(to []*common.Account) {
+				to[0].FetchOutcome.Alias = denied
+			},
+		},
+		{
+			name: "failed tags fetch is not removed tags",
+			from: []*common.Account{account("111111111111", "a", "env=prod")},
+			to:   []*common.Account{account("111111111111", "a")},
+			change: func(to []*common.Account) {
+				to[0].FetchOutcome.Tags = denied
+			},
+		},
+		{
+			name: "alias set",
+			from: []*common.Account{account("111111111111", "")},
+			to:   []*common.Account{account("111111111111", "a")},
+			want: []string{"realiased 111111111111 ->a"},
+		},
+		{
+			name: "state without outcomes",
+			from: []*common.Account{{Id: "111111111111", Alias: "a"}},
+			to:   []*common.Account{{Id: "111111111111", Alias: "b"}},
+			want: []string{"realiased 111111111111 a->b"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.change != nil {
+				tt.change(tt.to)
+			}
+
+			d := Compare(tt.from, tt.to)
+			got := summarize(d)
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("Compare returned\n  %s\nwant\n  %s", strings.Join(got, "\n  "), strings.Join(tt.want, "\n  "))
+			}
+			if d.Empty() != (len(tt.want) == 0) {
+				t.Errorf("Empty returned %v with changes %v", d.Empty(), got)
+			}
+		})
+	}
+}
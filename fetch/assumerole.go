@@ -0,0 +1,115 @@
+package fetch
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"regexp"
+	"runtime"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+
+	"github.com/logston/aws-aliased-profiles/common"
+)
+
+// maxSessionNameLength is the longest role session name STS accepts.
+const maxSessionNameLength = 64
+
+// invalidSessionNameChars matches the characters STS rejects in a role
+// session name.
+var invalidSessionNameChars = regexp.MustCompile(`[^\w+=,.@-]`)
+
+// AssumeRoleOptions returns a function that applies the settings to the
+// provider used to assume a role in the account with the given ID.
+func AssumeRoleOptions(s common.AssumeRoleSettings, accountId string) (func(*stscreds.AssumeRoleProvider), error) {
+	sessionName, err := RoleSessionName(s.SessionName, accountId)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(p *stscreds.AssumeRoleProvider) {
+		if s.ExternalId != "" {
+			p.ExternalID = &s.ExternalId
+		}
+		if sessionName != "" {
+			p.RoleSessionName = sessionName
+		}
+		if s.DurationSeconds != 0 {
+			p.Duration = time.Duration(s.DurationSeconds) * time.Second
+		}
+	}, nil
+}
+
+// RoleSessionName renders the session name template for the account with the
+// given ID. Characters STS does not allow are replaced with hyphens and the
+// name is truncated to the length STS allows.
+func RoleSessionName(tmpl, accountId string) (string, error) {
+	if tmpl == "" {
+		return "", nil
+	}
+
+	t, err := template.New("SessionName").Funcs(template.FuncMap{
+		"user":    currentUser,
+		"host":    os.Hostname,
+		"account": func() string { return accountId },
+	}).Parse(tmpl)
+	if err != nil {
+		return "", err
+	}
+
+	var b bytes.Buffer
+	if err = t.Execute(&b, nil); err != nil {
+		return "", err
+	}
+
+	name := invalidSessionNameChars.ReplaceAllString(b.String(), "-")
+	if len(name) > maxSessionNameLength {
+		name = name[:maxSessionNameLength]
+	}
+
+	return name, nil
+}
+
+func currentUser() (string, error) {
+	u, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+
+	// Drop the domain of Windows user names, e.g. DOMAIN\user.
+	parts := strings.Split(u.Username, `\`)
+
+	return parts[len(parts)-1], nil
+}
+
+// CommandTokenProvider returns an MFA token provider that runs command with
+// the shell and returns its trimmed output, so that MFA tokens can come from
+// a TOTP or password manager CLI instead of a prompt.
+func CommandTokenProvider(command string) func() (string, error) {
+	return func() (string, error) {
+		var cmd *exec.Cmd
+		if runtime.GOOS == "windows" {
+			cmd = exec.Command("cmd", "/C", command)
+		} else {
+			cmd = exec.Command("sh", "-c", command)
+		}
+		cmd.Stderr = os.Stderr
+
+		out, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("MFA command %q failed: %v", command, err)
+		}
+
+		token := strings.TrimSpace(string(out))
+		if token == "" {
+			return "", fmt.Errorf("MFA command %q printed no token", command)
+		}
+
+		return token, nil
+	}
+}
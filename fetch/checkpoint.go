@@ -0,0 +1,121 @@
+package fetch
+
+import (
+	"sync"
+	"time"
+
+	"github.com/logston/aws-aliased-profiles/common"
+)
+
+// checkpointInterval is the least time between two checkpoint writes.
+const checkpointInterval = 5 * time.Second
+
+// Checkpointer collects accounts as their tags or alias are fetched and
+// periodically writes them to the checkpoint of the organization, so that an
+// interrupted fetch can be resumed.
+type Checkpointer struct {
+	org       string
+	startedAt time.Time
+
+	mu        sync.Mutex
+	accounts  map[string]*common.Account
+	order     []string
+	lastWrite time.Time
+	dirty     bool
+}
+
+// NewCheckpointer returns a checkpointer for a fetch of the organization. When
+// resuming from prev, the accounts of prev are kept in the checkpoint.
+func NewCheckpointer(org string, prev *common.Checkpoint) *Checkpointer {
+	c := &Checkpointer{
+		org:       org,
+		startedAt: time.Now(),
+		accounts:  make(map[string]*common.Account),
+		lastWrite: time.Now(),
+	}
+
+	if prev != nil {
+		c.startedAt = prev.StartedAt
+		for _, a := range prev.Accounts {
+			c.accounts[a.Id] = a
+			c.order = append(c.order, a.Id)
+		}
+	}
+
+	return c
+}
+
+// DoneTags records the tags of the account, which were just fetched.
+func (c *Checkpointer) DoneTags(a *common.Account) {
+	c.update(a, func(cpa *common.Account) {
+		cpa.Tags = a.Tags
+		cpa.FetchedAt.Tags = a.FetchedAt.Tags
+		cpa.FetchOutcome.Tags = a.FetchOutcome.Tags
+	})
+}
+
+// DoneAlias records the alias of the account, and the roles discovered with
+// it, which were just fetched.
+func (c *Checkpointer) DoneAlias(a *common.Account) {
+	c.update(a, func(cpa *common.Account) {
+		cpa.Alias = a.Alias
+		cpa.AssumableRole = a.AssumableRole
+		cpa.FetchedAt.Alias = a.FetchedAt.Alias
+		cpa.FetchOutcome.Alias = a.FetchOutcome.Alias
+		cpa.Roles = a.Roles
+		cpa.FetchedAt.Roles = a.FetchedAt.Roles
+		cpa.FetchOutcome.Roles = a.FetchOutcome.Roles
+	})
+}
+
+// update applies set to the checkpointed copy of the account and writes the
+// checkpoint if it was not written recently. Only the attribute being
+// recorded is read from a, as the other may still be being fetched.
+func (c *Checkpointer) update(a *common.Account, set func(*common.Account)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cpa, ok := c.accounts[a.Id]
+	if !ok {
+		cpa = &common.Account{Id: a.Id}
+		c.accounts[a.Id] = cpa
+		c.order = append(c.order, a.Id)
+	}
+	set(cpa)
+	c.dirty = true
+
+	if time.Since(c.lastWrite) >= checkpointInterval {
+		c.write()
+	}
+}
+
+// Flush writes the checkpoint if any account was recorded since it was last
+// written.
+func (c *Checkpointer) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.dirty {
+		c.write()
+	}
+}
+
+func (c *Checkpointer) write() {
+	cp := &common.Checkpoint{StartedAt: c.startedAt}
+	for _, id := range c.order {
+		cpa := *c.accounts[id]
+		cp.Accounts = append(cp.Accounts, &cpa)
+	}
+
+	common.WriteCheckpoint(c.org, cp)
+	c.lastWrite = time.Now()
+	c.dirty = false
+}
+
+// NewResume returns a Reuse of the tags and aliases fetched since the
+// checkpoint was started.
+func NewResume(cp *common.Checkpoint) *Reuse {
+	sinceStart := time.Since(cp.StartedAt)
+
+	return NewReuse(cp.Accounts, sinceStart, sinceStart, false)
+}
@@ -3,16 +3,19 @@ package fetch
 import (
 	"context"
 	"fmt"
+	"os"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/iam"
 	"github.com/aws/aws-sdk-go/service/organizations"
-	"golang.org/x/sync/errgroup"
 
 	"github.com/logston/aws-aliased-profiles/common"
 )
@@ -20,173 +23,434 @@ import (
 // MaxResults defined by API is 20
 var MaxResults = aws.Int64(int64(20))
 
-func AliasToAccountMap(ctx context.Context, masterProfile, accountRole string) {
-	sess := session.Must(session.NewSessionWithOptions(session.Options{
-		SharedConfigState:       session.SharedConfigEnable,
-		AssumeRoleTokenProvider: stscreds.StdinTokenProvider,
-		Profile:                 masterProfile,
-	}))
+type Options struct {
+	// The name of the organization in the settings file, empty for an
+	// organization given on the command line.
+	Org string
 
-	oal, err := GetAWSOrganizationsAccounts(ctx, sess)
+	// Prepended to the profile name of each account in the organization.
+	ProfilePrefix string
+
+	// The profile used to list the accounts in the organization and from
+	// which AccountRoles are assumed in each account.
+	MasterProfile string
+
+	// The URL to send every Organizations, STS and IAM request to instead of
+	// the AWS endpoints, e.g. a LocalStack or fetchtest server. Requests to
+	// the IAM Identity Center portal are sent there too.
+	EndpointURL string
+
+	// The IAM Identity Center portal to fetch from with SSO, instead of the
+	// organization of MasterProfile.
+	SSO common.SSOSettings
+
+	// The role names to try assuming, in order, in each account to read its
+	// alias.
+	AccountRoles []string
+
+	// How AccountRoles are assumed and how MFA tokens are obtained for
+	// MasterProfile.
+	AssumeRole common.AssumeRoleSettings
+
+	// How the roles that may be assumed in each account are discovered.
+	// Roles are discovered along with the alias, and reused with it.
+	RoleDiscovery common.RoleDiscoverySettings
+
+	// The roots or organizational units to fetch accounts from, recursively.
+	// All roots are fetched when empty.
+	OUs []string
+
+	// The roots or organizational units whose accounts, recursively, are
+	// skipped.
+	ExcludeOUs []string
+
+	// Reuse the aliases and tags recorded by the previous fetch for accounts
+	// whose data is younger than AliasTTL and TagsTTL respectively.
+	Incremental bool
+	AliasTTL    time.Duration
+	TagsTTL     time.Duration
+
+	// Continue from the checkpoint left by an interrupted fetch, skipping the
+	// tags and aliases it already fetched.
+	Resume bool
+
+	// The maximum number of calls in flight to each AWS API.
+	Concurrency int
+
+	// The number of accounts whose tags and whose aliases are fetched at the
+	// same time. Concurrency is used when zero.
+	TagsConcurrency  int
+	AliasConcurrency int
+
+	// The requests per second allowed to each AWS API. The default of each
+	// API is used when zero.
+	RPS float64
+}
+
+// AliasToAccountMap fetches the accounts of a single organization from AWS
+// into its state file and returns the number of accounts whose alias or tags
+// could not be fetched.
+func AliasToAccountMap(ctx context.Context, opts Options) (failed int) {
+	if opts.Concurrency < 1 {
+		opts.Concurrency = 1
+	}
+
+	src := NewAWSSource(opts)
+	defer src.Limiters.PrintStats()
+
+	return Fetch(ctx, src, opts)
+}
+
+// Fetch fetches the accounts of a single organization from src into its state
+// file and returns the number of accounts whose alias or tags could not be
+// fetched. The options describing how to reach AWS are only used by
+// NewAWSSource and are ignored here.
+func Fetch(ctx context.Context, src AccountSource, opts Options) (failed int) {
+	if opts.Concurrency < 1 {
+		opts.Concurrency = 1
+	}
+
+	// Read the state before fetching anything, so that a remote backend only
+	// accepts the new state if no other run replaced it during the fetch.
+	state := common.ReadStateIfExists(opts.Org)
+
+	org, err := src.Organization(ctx)
 	if err != nil {
 		common.ExitWithError(err)
 	}
+	org.Name = opts.Org
+	org.ProfilePrefix = opts.ProfilePrefix
 
-	al := GetAccounts(oal)
+	var inc, resume *Reuse
+	if opts.Incremental && state != nil {
+		inc = NewReuse(state.Accounts, opts.TagsTTL, opts.AliasTTL, true)
+	}
 
-	if err = GetTagsForOU(ctx, sess, al); err != nil {
-		common.ExitWithError(err)
+	var prev *common.Checkpoint
+	if opts.Resume {
+		if prev = common.ReadCheckpoint(opts.Org); prev != nil {
+			resume = NewResume(prev)
+		} else {
+			fmt.Println("No checkpoint to resume from, starting over")
+		}
 	}
 
-	if err = GetAliases(ctx, sess, al, accountRole); err != nil {
-		common.ExitWithError(err)
+	cp := NewCheckpointer(opts.Org, prev)
+
+	var reusedTags, reusedAliases int64
+	p := &Pipeline{
+		Source:           src,
+		TagsConcurrency:  orDefault(opts.TagsConcurrency, opts.Concurrency),
+		AliasConcurrency: orDefault(opts.AliasConcurrency, opts.Concurrency),
+		Route: func(a *common.Account) (needTags, needAlias bool) {
+			a.Org = org
+
+			needTags, needAlias = true, true
+			if inc != nil {
+				needTags, needAlias = inc.Apply(a)
+			}
+			if resume != nil {
+				resumeTags, resumeAlias := resume.Apply(a)
+				needTags, needAlias = needTags && resumeTags, needAlias && resumeAlias
+			}
+
+			// Accounts whose roles were never discovered, e.g. because
+			// discovery was just enabled, need their alias fetched again.
+			if opts.RoleDiscovery.Enabled() && a.FetchedAt.Roles.IsZero() {
+				needAlias = true
+			}
+
+			if !needTags {
+				reusedTags++
+			}
+			if !needAlias {
+				reusedAliases++
+			}
+
+			return
+		},
+		TagsDone:  cp.DoneTags,
+		AliasDone: cp.DoneAlias,
+		Progress:  true,
 	}
 
-	common.WriteAccountList(al)
+	al, err := p.Run(ctx)
+	exitIfInterrupted(ctx, cp, err)
+
+	if reusedTags != 0 || reusedAliases != 0 {
+		fmt.Printf("Reused tags for %d and aliases for %d of %d accounts\n", reusedTags, reusedAliases, len(al))
+	}
+
+	common.WriteAccountList(opts.Org, al, common.StateMetadata{
+		ManagementProfile: opts.MasterProfile,
+		StartedAt:         cp.startedAt,
+		FinishedAt:        time.Now(),
+		OrganizationId:    org.Id,
+	})
+	common.RemoveCheckpoint(opts.Org)
+
+	return PrintFetchSummary(al)
 }
 
-func GetAWSOrganizationsAccounts(ctx context.Context, sess client.ConfigProvider) (oal []*organizations.Account, err error) {
-	svc := organizations.New(sess)
+// exitIfInterrupted saves the progress made so far and exits when err is not
+// nil.
+func exitIfInterrupted(ctx context.Context, cp *Checkpointer, err error) {
+	if err == nil {
+		return
+	}
 
-	var o *organizations.ListAccountsOutput
-	var nextToken *string
-	for {
-		if err = common.CheckContext(ctx); err != nil {
-			return nil, err
+	cp.Flush()
+
+	if ctx.Err() != nil {
+		fmt.Printf("\nInterrupted, progress saved to %s\n", common.GetCheckpointPath(cp.org))
+		fmt.Println("Run fetch again with --resume to continue")
+		os.Exit(130)
+	}
+
+	common.ExitWithError(err)
+}
+
+func orDefault(n, def int) int {
+	if n == 0 {
+		return def
+	}
+
+	return n
+}
+
+// Organizations fetches each organization in settings, or only those named
+// in names, into its own state file. Organizations whose accounts are
+// imported are skipped. Every option but the profile, role and profile
+// prefix, which come from the settings of each organization, is taken from
+// opts. It returns the number of accounts whose alias or tags could not be
+// fetched.
+func Organizations(ctx context.Context, opts Options, settings *common.Settings, names []string) (failed int) {
+	known := make(map[string]*common.OrganizationSettings)
+	for _, o := range settings.Organizations {
+		if !o.Import {
+			known[o.Name] = o
 		}
+	}
 
-		o, err = svc.ListAccounts(&organizations.ListAccountsInput{
-			MaxResults: MaxResults,
-			NextToken:  nextToken,
-		})
-		if err != nil {
-			_, cancel := context.WithCancel(ctx)
-			cancel()
-			return
+	selected := make(map[string]bool)
+	for _, name := range names {
+		if known[name] == nil {
+			for _, o := range settings.Organizations {
+				if o.Name == name && o.Import {
+					common.ExitWithError(fmt.Errorf("The accounts of organization %s are imported, please run 'aws-aliased-profiles import --org %s <file>' instead", name, name))
+				}
+			}
+			common.ExitWithError(fmt.Errorf("No organization named %s in settings", name))
 		}
+		selected[name] = true
+	}
 
-		oal = append(oal, o.Accounts...)
-		fmt.Printf("\rFetched %d accounts...", len(oal))
+	if len(known) == 0 {
+		common.ExitWithError(fmt.Errorf("No organizations to fetch in %s, please pass a profile and role", common.GetAPPath(common.SettingsFilename)))
+	}
 
-		if o.NextToken == nil {
-			break
+	for _, o := range settings.Organizations {
+		if o.Import || len(names) != 0 && !selected[o.Name] {
+			continue
 		}
 
-		nextToken = o.NextToken
+		fmt.Printf("Fetching organization %s...\n", o.Name)
+
+		orgOpts := opts
+		orgOpts.Org = o.Name
+		orgOpts.MasterProfile = o.Profile
+		orgOpts.AccountRoles = o.AccountRoles(settings)
+		orgOpts.AssumeRole = opts.AssumeRole.Or(o.AssumeRole).Or(settings.AssumeRole)
+		orgOpts.RoleDiscovery = opts.RoleDiscovery.Or(o.RoleDiscovery).Or(settings.RoleDiscovery)
+		orgOpts.ProfilePrefix = o.ProfilePrefix
+		if o.SSO.Enabled() {
+			orgOpts.SSO = o.SSO
+			failed += SSO(ctx, orgOpts)
+			continue
+		}
+		failed += AliasToAccountMap(ctx, orgOpts)
 	}
-	fmt.Println()
 
 	return
 }
 
-func GetAccounts(oal []*organizations.Account) (al []*common.Account) {
+// GetPartition returns the AWS partition of the session's region, e.g.
+// "aws-us-gov" for us-gov-west-1 or "aws-cn" for cn-north-1. It falls back to
+// the commercial partition when the session has no region.
+func GetPartition(sess *session.Session) string {
+	if p := GetPartitionForRegion(aws.StringValue(sess.Config.Region)); p != "" {
+		return p
+	}
+
+	return common.DefaultPartition
+}
+
+// GetPartitionForRegion returns the AWS partition of the region, or an empty
+// string if the region is empty or unknown.
+func GetPartitionForRegion(region string) string {
+	if p, ok := endpoints.PartitionForRegion(endpoints.DefaultPartitions(), region); ok && region != "" {
+		return p.ID()
+	}
+
+	return ""
+}
+
+// GetOrganization describes the organization that the session's account
+// belongs to.
+func GetOrganization(ctx context.Context, sess client.ConfigProvider, lim *Limiters) (org *common.Organization, err error) {
+	svc := organizations.New(sess)
+
+	var o *organizations.DescribeOrganizationOutput
+	err = lim.Organizations.Do(ctx, func() (e error) {
+		o, e = svc.DescribeOrganizationWithContext(ctx, &organizations.DescribeOrganizationInput{})
+		return
+	})
+	if err != nil {
+		return
+	}
+
+	return &common.Organization{
+		Id:              aws.StringValue(o.Organization.Id),
+		MasterAccountId: aws.StringValue(o.Organization.MasterAccountId),
+		FeatureSet:      aws.StringValue(o.Organization.FeatureSet),
+	}, nil
+}
+
+func GetAccounts(oal []*organizations.Account, ous []*common.OrganizationalUnit) (al []*common.Account) {
 	for _, oa := range oal {
 		al = append(al, &common.Account{
 			Id:              *oa.Id,
+			Name:            aws.StringValue(oa.Name),
+			Email:           aws.StringValue(oa.Email),
+			Arn:             aws.StringValue(oa.Arn),
 			JoinedTimestamp: *oa.JoinedTimestamp,
 			Status:          *oa.Status,
+			OUs:             ous,
 		})
 	}
 	return
 }
 
-func GetAliases(ctx context.Context, sess client.ConfigProvider, al []*common.Account, accountRole string) (err error) {
-	eg, ctx := errgroup.WithContext(ctx)
-
-	// Send a maximum of 10 concurrent requests to AWS at a time.
-	s := make(chan int, 10) // makeshift semaphore
-	for i, a := range al {
-		loopA := a
-		s <- i
-		eg.Go(func() error {
-			time.Sleep(time.Second) // Slow things down to avoid rate limits.
-			e := GetAlias(sess, loopA, accountRole)
-			<-s
-			return e
-		})
-		fmt.Printf("\rFetched aliases for %d accounts...", i+1)
-
-		if err = common.CheckContext(ctx); err != nil {
-			return
-		}
-	}
-
-	fmt.Println()
-
-	if err = eg.Wait(); err != nil {
-		return
-	}
+// GetAlias reads the alias of the account by assuming each of accountRoles in
+// turn until one of them may list the account aliases, however the roles
+// before it failed. The first role that could be assumed is recorded even if
+// it may not list the aliases.
+func GetAlias(ctx context.Context, sess client.ConfigProvider, lim *Limiters, a *common.Account, accountRoles []string, assumeRole common.AssumeRoleSettings) (err error) {
+	_, err = getAlias(ctx, sess, lim, a, accountRoles, assumeRole)
 	return
 }
 
-func GetAlias(sess client.ConfigProvider, a *common.Account, accountRole string) (err error) {
-	roleArn := fmt.Sprintf("arn:aws:iam::%s:role/%s", a.Id, accountRole)
-	creds := stscreds.NewCredentials(sess, roleArn)
-	svc := iam.New(sess, &aws.Config{Credentials: creds})
+// getAlias is GetAlias, also returning the credentials of a.AssumableRole, if
+// any role could be assumed.
+func getAlias(ctx context.Context, sess client.ConfigProvider, lim *Limiters, a *common.Account, accountRoles []string, assumeRole common.AssumeRoleSettings) (assumed *credentials.Credentials, err error) {
+	if len(accountRoles) == 0 {
+		return nil, fmt.Errorf("No role to assume in account %s", a.Id)
+	}
 
-	var o *iam.ListAccountAliasesOutput
-	o, err = svc.ListAccountAliases(&iam.ListAccountAliasesInput{})
+	assumeRoleOptions, err := AssumeRoleOptions(assumeRole, a.Id)
 	if err != nil {
-		if strings.HasPrefix(err.Error(), "AccessDenied") {
-			return nil
-		}
 		return
 	}
 
-	if len(o.AccountAliases) == 1 {
-		a.Alias = *o.AccountAliases[0]
+	a.AssumableRole = ""
+
+	// When every role fails, report the error of the role that got furthest:
+	// an error other than AccessDenied, e.g. a role that was still throttled
+	// after its retries, over a role that was assumed but may not list the
+	// aliases, over a role that could not be assumed.
+	var failErr error
+	failStatus, failRank := common.FetchAssumeRoleDenied, 0
+	fail := func(err error, deniedStatus string, rank int) {
+		if !isAccessDenied(err) {
+			rank = 2
+		}
+		if failErr == nil || rank > failRank {
+			failErr, failStatus, failRank = err, deniedStatus, rank
+		}
 	}
 
-	return
-}
-
-func GetTagsForOU(ctx context.Context, sess client.ConfigProvider, al []*common.Account) (err error) {
-	eg, ctx := errgroup.WithContext(ctx)
+	for _, accountRole := range accountRoles {
+		roleArn := a.RoleArn(accountRole)
+		creds := stscreds.NewCredentials(sess, roleArn, assumeRoleOptions)
+		svc := iam.New(sess, &aws.Config{Credentials: creds})
 
-	// Send a maximum of 1 concurrent requests to AWS at a time. Perhaps one
-	// day, this loop can be used to send more than one request at a time.
-	s := make(chan int, 1) // makeshift semaphore
-	for i, a := range al {
-		loopA := a
-		s <- i
-		eg.Go(func() error {
-			e := GetTagsForAccount(ctx, sess, loopA)
-			<-s
-			return e
+		// Assume the role up front so that STS calls are paced separately
+		// from IAM calls. The credentials are cached for the IAM call below.
+		err = lim.STS.Do(ctx, func() (e error) {
+			_, e = creds.GetWithContext(ctx)
+			return
 		})
-		fmt.Printf("\rFetched tags for %d accounts...", i+1)
+		if err != nil {
+			if ctxErr := common.CheckContext(ctx); ctxErr != nil {
+				return assumed, ctxErr
+			}
+			fail(err, common.FetchAssumeRoleDenied, 0)
+			continue
+		}
 
-		if err = common.CheckContext(ctx); err != nil {
+		if a.AssumableRole == "" {
+			a.AssumableRole = accountRole
+			assumed = creds
+		}
+
+		var o *iam.ListAccountAliasesOutput
+		err = lim.IAM.Do(ctx, func() (e error) {
+			o, e = svc.ListAccountAliasesWithContext(ctx, &iam.ListAccountAliasesInput{})
 			return
+		})
+		if err != nil {
+			if ctxErr := common.CheckContext(ctx); ctxErr != nil {
+				return assumed, ctxErr
+			}
+			fail(err, common.FetchListAliasesDenied, 1)
+			continue
 		}
-	}
 
-	fmt.Println()
+		a.AssumableRole = accountRole
+		assumed = creds
+		a.Alias = ""
+		if len(o.AccountAliases) == 1 {
+			a.Alias = *o.AccountAliases[0]
+		}
+		a.FetchedAt.Alias = time.Now()
+		a.FetchOutcome.Alias = common.FetchOutcome{Status: common.FetchOK}
 
-	if err = eg.Wait(); err != nil {
 		return
 	}
-	return
+
+	return assumed, recordFailure(ctx, &a.FetchOutcome.Alias, failErr, failStatus)
 }
 
-func GetTagsForAccount(ctx context.Context, sess client.ConfigProvider, a *common.Account) (err error) {
-	svc := organizations.New(sess)
+func GetTagsForAccount(ctx context.Context, sess client.ConfigProvider, lim *Limiters, a *common.Account) (err error) {
+	tags, err := listTags(ctx, organizations.New(sess), lim, a.Id)
+	if err != nil {
+		return recordFailure(ctx, &a.FetchOutcome.Tags, err, common.FetchListTagsDenied)
+	}
 
+	a.Tags = tags
+	a.FetchedAt.Tags = time.Now()
+	a.FetchOutcome.Tags = common.FetchOutcome{Status: common.FetchOK}
+
+	return
+}
+
+// listTags lists the tags on an account, root or organizational unit.
+func listTags(ctx context.Context, svc *organizations.Organizations, lim *Limiters, resourceId string) (tags []*common.Tag, err error) {
 	var o *organizations.ListTagsForResourceOutput
 	var nextToken *string
-	var tags []*common.Tag
 	for {
 		if err = common.CheckContext(ctx); err != nil {
 			return
 		}
 
-		o, err = svc.ListTagsForResource(&organizations.ListTagsForResourceInput{
-			ResourceId: &a.Id,
-			NextToken:  nextToken,
+		err = lim.Organizations.Do(ctx, func() (e error) {
+			o, e = svc.ListTagsForResourceWithContext(ctx, &organizations.ListTagsForResourceInput{
+				ResourceId: &resourceId,
+				NextToken:  nextToken,
+			})
+			return
 		})
 		if err != nil {
-			_, cancel := context.WithCancel(ctx)
-			cancel()
 			return
 		}
 
@@ -205,7 +469,30 @@ func GetTagsForAccount(ctx context.Context, sess client.ConfigProvider, a *commo
 		nextToken = o.NextToken
 	}
 
-	a.Tags = tags
-
 	return
 }
+
+// recordFailure records the outcome of a failed fetch so that the remaining
+// accounts are still fetched. Only cancellation of ctx is returned, which
+// stops the whole fetch.
+func recordFailure(ctx context.Context, o *common.FetchOutcome, err error, deniedStatus string) error {
+	if ctxErr := common.CheckContext(ctx); ctxErr != nil {
+		return ctxErr
+	}
+
+	status := common.FetchFailed
+	switch {
+	case isAccessDenied(err):
+		status = deniedStatus
+	case request.IsErrorThrottle(err):
+		status = common.FetchThrottled
+	}
+
+	*o = common.FetchOutcome{Status: status, Error: err.Error()}
+
+	return nil
+}
+
+func isAccessDenied(err error) bool {
+	return strings.HasPrefix(err.Error(), "AccessDenied")
+}
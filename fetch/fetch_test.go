@@ -0,0 +1,632 @@
+package fetch
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+
+	"github.com/logston/aws-aliased-profiles/common"
+	"github.com/logston/aws-aliased-profiles/fetch/fetchtest"
+)
+
+// useHome points HOME at a new, empty home directory until the end of the
+// test, as fetch reads and writes the state and checkpoint in
+// ~/.aws/aliased-profiles.
+func useHome(t testing.TB) string {
+	t.Helper()
+
+	home, err := ioutil.TempDir("", "fetch-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(home, ".aws", common.DirName), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	setenv(t, "HOME", home)
+	t.Cleanup(func() { os.RemoveAll(home) })
+
+	return home
+}
+
+// setenv sets, or unsets when value is empty, an environment variable until
+// the end of the test.
+func setenv(t testing.TB, key, value string) {
+	prev, ok := os.LookupEnv(key)
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, prev)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+
+	if value == "" {
+		os.Unsetenv(key)
+	} else {
+		os.Setenv(key, value)
+	}
+}
+
+// serverOptions returns the options to fetch from s with the fetchtest
+// profile, written to a shared config file in the home directory of the test.
+// Calls are barely paced so that the tests run quickly.
+func serverOptions(t testing.TB, s *fetchtest.Server) Options {
+	t.Helper()
+
+	config := filepath.Join(os.Getenv("HOME"), ".aws", "fetchtest-config")
+	err := ioutil.WriteFile(config, []byte(`[profile fetchtest]
+aws_access_key_id = fetchtest
+aws_secret_access_key = fetchtest
+region = us-east-1
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setenv(t, "AWS_CONFIG_FILE", config)
+	setenv(t, "AWS_SHARED_CREDENTIALS_FILE", config)
+	for _, key := range []string{"AWS_PROFILE", "AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN", "AWS_REGION"} {
+		setenv(t, key, "")
+	}
+
+	return Options{
+		MasterProfile: "fetchtest",
+		EndpointURL:   s.URL,
+		AccountRoles:  []string{"FetchRole"},
+		Concurrency:   4,
+		RPS:           1000,
+	}
+}
+
+// countingSource counts the accounts whose tags and alias are fetched from
+// the source it wraps.
+type countingSource struct {
+	AccountSource
+
+	mu    sync.Mutex
+	tags  map[string]int
+	alias map[string]int
+}
+
+func newCountingSource(src AccountSource) *countingSource {
+	return &countingSource{
+		AccountSource: src,
+		tags:          make(map[string]int),
+		alias:         make(map[string]int),
+	}
+}
+
+func (s *countingSource) Tags(ctx context.Context, a *common.Account) error {
+	s.mu.Lock()
+	s.tags[a.Id]++
+	s.mu.Unlock()
+
+	return s.AccountSource.Tags(ctx, a)
+}
+
+func (s *countingSource) Alias(ctx context.Context, a *common.Account) error {
+	s.mu.Lock()
+	s.alias[a.Id]++
+	s.mu.Unlock()
+
+	return s.AccountSource.Alias(ctx, a)
+}
+
+// newMemorySource returns a source of n accounts, listed two at a time, each
+// with an alias and an environment tag.
+func newMemorySource(n int) *MemorySource {
+	src := &MemorySource{
+		Org:      &common.Organization{Id: "o-memory"},
+		PageSize: 2,
+	}
+	for i := 0; i < n; i++ {
+		id := fmt.Sprintf("%012d", 100000000000+i+1)
+		src.Accounts = append(src.Accounts, &common.Account{
+			Id:     id,
+			Name:   fmt.Sprintf("Account %d", i+1),
+			Status: "ACTIVE",
+			Alias:  fmt.Sprintf("account-%d", i+1),
+			Tags:   []*common.Tag{{Key: "environment", Value: "test"}},
+		})
+	}
+
+	return src
+}
+
+// stateById returns the accounts in the state of the organization by ID.
+func stateById(t *testing.T, org string) map[string]*common.Account {
+	t.Helper()
+
+	st := common.ReadState(org)
+
+	m := make(map[string]*common.Account, len(st.Accounts))
+	for _, a := range st.Accounts {
+		m[a.Id] = a
+	}
+
+	return m
+}
+
+func TestFetchMemorySource(t *testing.T) {
+	useHome(t)
+
+	src := newMemorySource(5)
+	ids := []string{src.Accounts[0].Id, src.Accounts[1].Id, src.Accounts[2].Id}
+	src.TagsErrors = map[string]error{ids[1]: awserr.New("AccessDeniedException", "denied", nil)}
+	src.AliasErrors = map[string]error{ids[2]: awserr.New("AccessDenied", "denied", nil)}
+
+	failed := Fetch(context.Background(), src, Options{Concurrency: 2})
+	if failed != 2 {
+		t.Errorf("Fetch reported %d failed accounts, want 2", failed)
+	}
+
+	st := common.ReadState("")
+	if len(st.Accounts) != 5 {
+		t.Fatalf("state has %d accounts, want 5", len(st.Accounts))
+	}
+	if st.Metadata.OrganizationId != "o-memory" || st.Metadata.FinishedAt.IsZero() {
+		t.Errorf("state metadata is %+v", st.Metadata)
+	}
+
+	accounts := stateById(t, "")
+
+	a := accounts[ids[0]]
+	if a.Alias != "account-1" || len(a.Tags) != 1 || a.Name != "Account 1" {
+		t.Errorf("account %s is %+v", a.Id, a)
+	}
+	if a.FetchOutcome.Alias.Status != common.FetchOK || a.FetchOutcome.Tags.Status != common.FetchOK {
+		t.Errorf("outcomes of %s are %+v", a.Id, a.FetchOutcome)
+	}
+
+	if o := accounts[ids[1]].FetchOutcome; o.Tags.Status != common.FetchListTagsDenied || o.Alias.Status != common.FetchOK {
+		t.Errorf("outcomes of %s are %+v, want tags %s", ids[1], o, common.FetchListTagsDenied)
+	}
+	if o := accounts[ids[2]].FetchOutcome; o.Alias.Status != common.FetchAssumeRoleDenied || o.Tags.Status != common.FetchOK {
+		t.Errorf("outcomes of %s are %+v, want alias %s", ids[2], o, common.FetchAssumeRoleDenied)
+	}
+
+	if common.ReadCheckpoint("") != nil {
+		t.Error("the checkpoint was not removed after the fetch finished")
+	}
+}
+
+func TestFetchIncremental(t *testing.T) {
+	useHome(t)
+
+	src := newMemorySource(4)
+	Fetch(context.Background(), src, Options{})
+
+	// The aliases and tags in the state are reused while younger than the
+	// TTLs, even though the organization changed.
+	src.Accounts[0].Alias = "renamed"
+	counting := newCountingSource(src)
+	Fetch(context.Background(), counting, Options{
+		Incremental: true,
+		AliasTTL:    time.Hour,
+		TagsTTL:     time.Hour,
+	})
+
+	if len(counting.tags) != 0 || len(counting.alias) != 0 {
+		t.Errorf("fetched tags of %v and aliases of %v, want none", counting.tags, counting.alias)
+	}
+	if a := stateById(t, "")[src.Accounts[0].Id]; a.Alias != "account-1" {
+		t.Errorf("alias of %s is %q, want the reused account-1", a.Id, a.Alias)
+	}
+
+	// Stale aliases are fetched again, and new accounts are fetched in full.
+	src.Accounts = append(src.Accounts, &common.Account{Id: "100000000099", Alias: "new"})
+	counting = newCountingSource(src)
+	Fetch(context.Background(), counting, Options{
+		Incremental: true,
+		AliasTTL:    0,
+		TagsTTL:     time.Hour,
+	})
+
+	if len(counting.alias) != 5 || len(counting.tags) != 1 || counting.tags["100000000099"] != 1 {
+		t.Errorf("fetched tags of %v and aliases of %v, want the tags of the new account and every alias", counting.tags, counting.alias)
+	}
+	if a := stateById(t, "")[src.Accounts[0].Id]; a.Alias != "renamed" {
+		t.Errorf("alias of %s is %q, want renamed", a.Id, a.Alias)
+	}
+}
+
+func TestFetchResume(t *testing.T) {
+	useHome(t)
+
+	src := newMemorySource(5)
+	ctx := context.Background()
+
+	// Record the first three accounts as an interrupted fetch would.
+	cp := NewCheckpointer("", nil)
+	for _, sa := range src.Accounts[:3] {
+		a := &common.Account{Id: sa.Id}
+		if err := src.Tags(ctx, a); err != nil {
+			t.Fatal(err)
+		}
+		cp.DoneTags(a)
+		if err := src.Alias(ctx, a); err != nil {
+			t.Fatal(err)
+		}
+		cp.DoneAlias(a)
+	}
+	cp.Flush()
+
+	prev := common.ReadCheckpoint("")
+	if prev == nil || len(prev.Accounts) != 3 {
+		t.Fatalf("checkpoint is %+v, want 3 accounts", prev)
+	}
+
+	counting := newCountingSource(src)
+	if failed := Fetch(ctx, counting, Options{Resume: true}); failed != 0 {
+		t.Errorf("Fetch reported %d failed accounts, want 0", failed)
+	}
+
+	for i, sa := range src.Accounts {
+		want := 0
+		if i >= 3 {
+			want = 1
+		}
+		if counting.tags[sa.Id] != want || counting.alias[sa.Id] != want {
+			t.Errorf("fetched the tags of %s %d times and its alias %d times, want %d", sa.Id, counting.tags[sa.Id], counting.alias[sa.Id], want)
+		}
+	}
+
+	accounts := stateById(t, "")
+	for _, sa := range src.Accounts {
+		if a := accounts[sa.Id]; a == nil || a.Alias != sa.Alias || len(a.Tags) != 1 {
+			t.Errorf("account %s in the state is %+v", sa.Id, a)
+		}
+	}
+
+	if common.ReadCheckpoint("") != nil {
+		t.Error("the checkpoint was not removed after the fetch finished")
+	}
+}
+
+func TestRoleArns(t *testing.T) {
+	setenv(t, "AWS_REGION", "")
+	setenv(t, "AWS_DEFAULT_REGION", "")
+
+	tests := []struct {
+		region string
+		role   string
+		want   string
+	}{
+		{"us-east-1", "ReadOnly", "arn:aws:iam::111111111111:role/ReadOnly"},
+		{"", "ReadOnly", "arn:aws:iam::111111111111:role/ReadOnly"},
+		{"us-gov-west-1", "team/ReadOnly", "arn:aws-us-gov:iam::111111111111:role/team/ReadOnly"},
+		{"cn-north-1", "/team/ReadOnly", "arn:aws-cn:iam::111111111111:role/team/ReadOnly"},
+		{"eu-west-1", "role/team/ReadOnly", "arn:aws:iam::111111111111:role/team/ReadOnly"},
+	}
+
+	for _, tt := range tests {
+		sess, err := session.NewSession(&aws.Config{Region: aws.String(tt.region)})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		a := &common.Account{Id: "111111111111", Org: &common.Organization{Partition: GetPartition(sess)}}
+		if got := a.RoleArn(tt.role); got != tt.want {
+			t.Errorf("ARN of %s in %s is %s, want %s", tt.role, tt.region, got, tt.want)
+		}
+	}
+}
+
+func TestAliasToAccountMap(t *testing.T) {
+	useHome(t)
+
+	s := fetchtest.NewServer()
+	defer s.Close()
+
+	// Two organizational units of four accounts each, listed three at a
+	// time.
+	s.SetPageSize(3)
+	ids := s.Generate(8, 2)
+
+	s.Throttle("ListAccountsForParent", 2)
+	s.Throttle("ListTagsForResource", 3)
+	s.Throttle("AssumeRole", 2)
+	s.DenyAssumeRole(ids[1])
+	s.DenyListAliases(ids[2])
+	s.DenyListTags(ids[3])
+
+	failed := AliasToAccountMap(context.Background(), serverOptions(t, s))
+	if failed != 3 {
+		t.Errorf("AliasToAccountMap reported %d failed accounts, want 3", failed)
+	}
+
+	// The empty root and each page of both organizational units, after the
+	// throttled calls were retried.
+	if n := s.Calls("ListAccountsForParent"); n != 2+1+2*2 {
+		t.Errorf("ListAccountsForParent was called %d times, want %d", n, 2+1+2*2)
+	}
+	if n := s.Calls("AssumeRole"); n != 2+len(ids) {
+		t.Errorf("AssumeRole was called %d times, want %d", n, 2+len(ids))
+	}
+
+	accounts := stateById(t, "")
+	if len(accounts) != len(ids) {
+		t.Fatalf("state has %d accounts, want %d", len(accounts), len(ids))
+	}
+
+	a := accounts[ids[0]]
+	if a.Alias != "account-1" || a.AssumableRole != "FetchRole" || a.OUPath() != "Root/OU 1" {
+		t.Errorf("account %s is %+v in %s", a.Id, a, a.OUPath())
+	}
+	if a.EffectiveTag("environment") != "production" || a.EffectiveTag("cost-center") != "cc-1" {
+		t.Errorf("effective tags of %s are %v", a.Id, a.EffectiveTags())
+	}
+
+	want := map[string]common.FetchOutcomes{
+		ids[0]: {Alias: common.FetchOutcome{Status: common.FetchOK}, Tags: common.FetchOutcome{Status: common.FetchOK}},
+		ids[1]: {Alias: common.FetchOutcome{Status: common.FetchAssumeRoleDenied}, Tags: common.FetchOutcome{Status: common.FetchOK}},
+		ids[2]: {Alias: common.FetchOutcome{Status: common.FetchListAliasesDenied}, Tags: common.FetchOutcome{Status: common.FetchOK}},
+		ids[3]: {Alias: common.FetchOutcome{Status: common.FetchOK}, Tags: common.FetchOutcome{Status: common.FetchListTagsDenied}},
+	}
+	for id, o := range want {
+		got := accounts[id].FetchOutcome
+		if got.Alias.Status != o.Alias.Status || got.Tags.Status != o.Tags.Status {
+			t.Errorf("outcomes of %s are alias %q and tags %q, want %q and %q", id, got.Alias.Status, got.Tags.Status, o.Alias.Status, o.Tags.Status)
+		}
+	}
+	for _, id := range ids[4:] {
+		if o := accounts[id].FetchOutcome; o.Alias.Failed() || o.Tags.Failed() {
+			t.Errorf("outcomes of %s are %+v, want ok", id, o)
+		}
+	}
+
+	// Only the account whose AssumeRole is denied has no assumable role.
+	if a := accounts[ids[1]]; a.AssumableRole != "" || a.Alias != "" {
+		t.Errorf("account %s has role %q and alias %q, want neither", a.Id, a.AssumableRole, a.Alias)
+	}
+	if a := accounts[ids[2]]; a.AssumableRole != "FetchRole" {
+		t.Errorf("account %s has role %q, want FetchRole", a.Id, a.AssumableRole)
+	}
+}
+
+func TestAliasToAccountMapRoles(t *testing.T) {
+	useHome(t)
+
+	s := fetchtest.NewServer()
+	defer s.Close()
+
+	profile := []*common.Tag{{Key: "profile", Value: "yes"}}
+	s.AddAccount(s.RootId(), &fetchtest.Account{Id: "111111111111", Name: "Prod", Alias: "prod", Roles: []*fetchtest.Role{
+		{Name: "FetchRole"},
+		{Name: "Admin", Tags: profile},
+		{Path: "/team/", Name: "ReadOnly", Tags: profile},
+		{Path: "/other/", Name: "Deploy", Tags: profile},
+		{Name: "Untagged"},
+		{Name: "Denied", Tags: profile},
+	}})
+	s.AddAccount(s.RootId(), &fetchtest.Account{Id: "222222222222", Name: "Dev", Alias: "dev", Roles: []*fetchtest.Role{
+		{Name: "FetchRole"},
+	}})
+	s.DenyAssumeRole("111111111111", "Denied")
+	s.DenyListRoles("222222222222")
+
+	// The candidates are probed, and the listed roles that are tagged and
+	// beneath the path prefix, or at the root.
+	opts := serverOptions(t, s)
+	opts.RoleDiscovery = common.RoleDiscoverySettings{
+		Candidates: []string{"Admin", "Missing"},
+		List:       true,
+		PathPrefix: "/",
+		Tags:       []string{"profile=yes"},
+	}
+	if failed := AliasToAccountMap(context.Background(), opts); failed != 1 {
+		t.Errorf("AliasToAccountMap reported %d failed accounts, want 1", failed)
+	}
+
+	accounts := stateById(t, "")
+	a := accounts["111111111111"]
+	if got := strings.Join(a.Roles, ","); got != "Admin,team/ReadOnly,other/Deploy" {
+		t.Errorf("roles of %s are %s, want Admin,team/ReadOnly,other/Deploy", a.Id, got)
+	}
+	if a.FetchOutcome.Roles.Status != common.FetchOK || a.FetchedAt.Roles.IsZero() {
+		t.Errorf("roles of %s were fetched at %v with outcome %+v", a.Id, a.FetchedAt.Roles, a.FetchOutcome.Roles)
+	}
+
+	a = accounts["222222222222"]
+	if o := a.FetchOutcome.Roles; o.Status != common.FetchListRolesDenied || len(a.Roles) != 0 {
+		t.Errorf("roles of %s are %v with outcome %+v, want none with %s", a.Id, a.Roles, o, common.FetchListRolesDenied)
+	}
+	if a.Alias != "dev" || a.FetchOutcome.Alias.Failed() {
+		t.Errorf("alias of %s is %q with outcome %+v, want dev", a.Id, a.Alias, a.FetchOutcome.Alias)
+	}
+}
+
+func TestAliasToAccountMapOUs(t *testing.T) {
+	useHome(t)
+
+	s := fetchtest.NewServer()
+	defer s.Close()
+
+	workloads := s.AddOU(s.RootId(), "Workloads")
+	prod := s.AddOU(workloads, "Prod")
+	dev := s.AddOU(workloads, "Dev")
+	s.AddAccount(s.RootId(), &fetchtest.Account{Id: "111111111111", Name: "Management"})
+	s.AddAccount(workloads, &fetchtest.Account{Id: "222222222222", Name: "Shared"})
+	s.AddAccount(prod, &fetchtest.Account{Id: "333333333333", Name: "Prod"})
+	s.AddAccount(dev, &fetchtest.Account{Id: "444444444444", Name: "Dev"})
+
+	opts := serverOptions(t, s)
+	opts.OUs = []string{workloads}
+	opts.ExcludeOUs = []string{dev}
+	if failed := AliasToAccountMap(context.Background(), opts); failed != 0 {
+		t.Errorf("AliasToAccountMap reported %d failed accounts, want 0", failed)
+	}
+
+	accounts := stateById(t, "")
+	if len(accounts) != 2 || accounts["222222222222"] == nil || accounts["333333333333"] == nil {
+		t.Fatalf("state has accounts %v, want 222222222222 and 333333333333", accounts)
+	}
+	if p := accounts["333333333333"].OUPath(); p != "Root/Workloads/Prod" {
+		t.Errorf("OU path of 333333333333 is %q, want Root/Workloads/Prod", p)
+	}
+}
+
+func TestAliasToAccountMapOUTagsDenied(t *testing.T) {
+	useHome(t)
+
+	s := fetchtest.NewServer()
+	defer s.Close()
+
+	prod := s.AddOU(s.RootId(), "Prod")
+	dev := s.AddOU(s.RootId(), "Dev")
+	s.AddAccount(prod, &fetchtest.Account{Id: "111111111111", Name: "Prod 1"})
+	s.AddAccount(prod, &fetchtest.Account{Id: "222222222222", Name: "Prod 2"})
+	s.AddAccount(dev, &fetchtest.Account{Id: "333333333333", Name: "Dev"})
+	s.DenyListTags(prod)
+
+	// Both accounts beneath Prod are missing its tags.
+	if failed := AliasToAccountMap(context.Background(), serverOptions(t, s)); failed != 2 {
+		t.Errorf("AliasToAccountMap reported %d failed accounts, want 2", failed)
+	}
+
+	accounts := stateById(t, "")
+	ou := accounts["111111111111"].OUs[1]
+	if ou.Id != prod || ou.FetchOutcome.Status != common.FetchListTagsDenied {
+		t.Errorf("OU of 111111111111 is %s with outcome %+v, want %s with %s", ou.Id, ou.FetchOutcome, prod, common.FetchListTagsDenied)
+	}
+	if o := accounts["333333333333"].OUs[1].FetchOutcome; o.Status != common.FetchOK {
+		t.Errorf("outcome of the tags of %s is %+v, want ok", dev, o)
+	}
+}
+
+func TestOrganizationsSkipsImported(t *testing.T) {
+	useHome(t)
+
+	s := fetchtest.NewServer()
+	defer s.Close()
+	s.Generate(2, 0)
+
+	imported := []*common.Account{{Id: "999999999999", Alias: "partner-prod", Org: &common.Organization{Name: "partner"}}}
+	common.WriteAccountList("partner", imported, common.StateMetadata{ImportedFrom: "partners.csv"})
+
+	opts := serverOptions(t, s)
+	settings := &common.Settings{Organizations: []*common.OrganizationSettings{
+		{Name: "commercial", Profile: opts.MasterProfile, Role: "FetchRole"},
+		{Name: "partner", Import: true},
+	}}
+	if failed := Organizations(context.Background(), opts, settings, nil); failed != 0 {
+		t.Errorf("Organizations reported %d failed accounts, want 0", failed)
+	}
+
+	if n := len(stateById(t, "commercial")); n != 2 {
+		t.Errorf("state of commercial has %d accounts, want 2", n)
+	}
+	st := common.ReadState("partner")
+	if len(st.Accounts) != 1 || st.Accounts[0].Id != "999999999999" || !st.Metadata.Imported() {
+		t.Errorf("state of partner is %+v with accounts %v, want the imported account", st.Metadata, st.Accounts)
+	}
+}
+
+func TestSSO(t *testing.T) {
+	home := useHome(t)
+
+	s := fetchtest.NewServer()
+	defer s.Close()
+
+	s.SetPageSize(3)
+	ids := s.Generate(5, 0)
+	s.SetRoles(ids[0], "AdministratorAccess", "ReadOnly")
+	s.SetRoles(ids[1], "ReadOnly")
+
+	if err := fetchtest.WriteSSOToken(home, fetchtest.SSOStartURL); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := Options{
+		SSO:         common.SSOSettings{StartURL: fetchtest.SSOStartURL, Region: fetchtest.SSORegion},
+		EndpointURL: s.URL,
+		Concurrency: 2,
+		RPS:         1000,
+	}
+	if failed := SSO(context.Background(), opts); failed != 0 {
+		t.Errorf("SSO reported %d failed accounts, want 0", failed)
+	}
+
+	accounts := stateById(t, "")
+	if len(accounts) != len(ids) {
+		t.Fatalf("state has %d accounts, want %d", len(accounts), len(ids))
+	}
+	a := accounts[ids[0]]
+	if a.Name != "Account 1" || strings.Join(a.Roles, ",") != "AdministratorAccess,ReadOnly" {
+		t.Errorf("account %s is %+v", a.Id, a)
+	}
+	if a.Org.SSOStartURL != fetchtest.SSOStartURL || a.FetchOutcome.Roles.Status != common.FetchOK {
+		t.Errorf("account %s has organization %+v and outcomes %+v", a.Id, a.Org, a.FetchOutcome)
+	}
+
+	// The roles are reused like aliases.
+	listed := s.Calls("sso.ListAccountRoles")
+	opts.Incremental = true
+	opts.AliasTTL = time.Hour
+	SSO(context.Background(), opts)
+
+	if n := s.Calls("sso.ListAccountRoles") - listed; n != 0 {
+		t.Errorf("sso.ListAccountRoles was called %d times by an incremental fetch, want 0", n)
+	}
+	if a := stateById(t, "")[ids[1]]; strings.Join(a.Roles, ",") != "ReadOnly" {
+		t.Errorf("roles of %s are %v, want the reused ReadOnly", a.Id, a.Roles)
+	}
+}
+
+// shortBackoff makes retries back off for a millisecond at most until the end
+// of the test.
+func shortBackoff(t *testing.T) {
+	base, max := baseBackoff, maxBackoff
+	baseBackoff, maxBackoff = time.Millisecond, time.Millisecond
+	t.Cleanup(func() { baseBackoff, maxBackoff = base, max })
+}
+
+func TestAliasToAccountMapFallbackRoles(t *testing.T) {
+	useHome(t)
+	shortBackoff(t)
+
+	s := fetchtest.NewServer()
+	defer s.Close()
+
+	s.AddAccount(s.RootId(), &fetchtest.Account{Id: "111111111111", Name: "Prod", Alias: "prod"})
+
+	// Every attempt to assume the first role is throttled, so the second
+	// role is tried.
+	s.Throttle("AssumeRole", MaxAttempts)
+
+	opts := serverOptions(t, s)
+	opts.AccountRoles = []string{"FetchRole", "FallbackRole"}
+	if failed := AliasToAccountMap(context.Background(), opts); failed != 0 {
+		t.Errorf("AliasToAccountMap reported %d failed accounts, want 0", failed)
+	}
+
+	a := stateById(t, "")["111111111111"]
+	if a.Alias != "prod" || a.AssumableRole != "FallbackRole" || a.FetchOutcome.Alias.Status != common.FetchOK {
+		t.Errorf("account %s has alias %q, role %q and outcome %+v, want prod, FallbackRole and ok", a.Id, a.Alias, a.AssumableRole, a.FetchOutcome.Alias)
+	}
+	if n := s.Calls("AssumeRole"); n != MaxAttempts+1 {
+		t.Errorf("AssumeRole was called %d times, want %d", n, MaxAttempts+1)
+	}
+
+	// When every role fails, the throttling is reported rather than the
+	// role that was denied after it.
+	s.Throttle("AssumeRole", MaxAttempts)
+	s.DenyAssumeRole("111111111111", "FallbackRole")
+	if failed := AliasToAccountMap(context.Background(), opts); failed != 1 {
+		t.Errorf("AliasToAccountMap reported %d failed accounts, want 1", failed)
+	}
+	if o := stateById(t, "")["111111111111"].FetchOutcome.Alias; o.Status != common.FetchThrottled {
+		t.Errorf("alias outcome is %+v, want %s", o, common.FetchThrottled)
+	}
+}
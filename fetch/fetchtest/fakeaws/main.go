@@ -0,0 +1,117 @@
+// Command fakeaws serves a generated organization from a fetchtest.Server
+// until interrupted, so that the real fetch command can be pointed at it:
+//
+//	go run ./fetch/fetchtest/fakeaws -accounts 100 -deny-every 10
+//
+// It writes a shared config file with a fetchtest profile holding dummy
+// credentials, and a home directory whose SSO token cache holds the token of
+// its IAM Identity Center portal, and prints the command lines to run fetch
+// against it.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/logston/aws-aliased-profiles/fetch/fetchtest"
+)
+
+func main() {
+	accounts := flag.Int("accounts", 100, "number of accounts in the organization")
+	ous := flag.Int("ous", 5, "number of organizational units the accounts are spread across")
+	pageSize := flag.Int("page-size", fetchtest.DefaultPageSize, "most accounts, organizational units or tags in a page")
+	denyEvery := flag.Int("deny-every", 0, "deny AssumeRole in every nth account")
+	roles := flag.String("roles", "", "comma separated roles, e.g. FetchRole,Admin,team/ReadOnly, in every account instead of any role")
+	throttle := flag.Int("throttle", 0, "throttle the first n calls to each operation fetch makes")
+	flag.Parse()
+
+	s := fetchtest.NewServer()
+	defer s.Close()
+
+	s.SetPageSize(*pageSize)
+	ids := s.Generate(*accounts, *ous)
+
+	if *roles != "" {
+		for _, id := range ids {
+			s.SetRoles(id, strings.Split(*roles, ",")...)
+		}
+	}
+
+	if *denyEvery > 0 {
+		for i := *denyEvery - 1; i < len(ids); i += *denyEvery {
+			s.DenyAssumeRole(ids[i])
+		}
+	}
+
+	if *throttle > 0 {
+		for _, op := range []string{
+			"DescribeOrganization",
+			"ListRoots",
+			"ListAccountsForParent",
+			"ListOrganizationalUnitsForParent",
+			"ListTagsForResource",
+			"AssumeRole",
+			"ListAccountAliases",
+			"ListRoles",
+			"sso.ListAccounts",
+			"sso.ListAccountRoles",
+		} {
+			s.Throttle(op, *throttle)
+		}
+	}
+
+	config, err := writeConfig()
+	if err != nil {
+		panic(err)
+	}
+	defer os.Remove(config)
+
+	home, err := ioutil.TempDir("", "fakeaws-home-")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(home)
+
+	if err := fetchtest.WriteSSOToken(home, fetchtest.SSOStartURL); err != nil {
+		panic(err)
+	}
+
+	fmt.Printf("Serving %d accounts at %s\n\n", len(ids), s.URL)
+	fmt.Println("Fetch them with:")
+	fmt.Printf("  AWS_CONFIG_FILE=%s \\\n", config)
+	fmt.Printf("    aws-aliased-profiles fetch --endpoint-url %s fetchtest FetchRole\n\n", s.URL)
+	fmt.Println("or, through IAM Identity Center, with a home whose token cache holds the portal's token:")
+	fmt.Printf("  HOME=%s \\\n", home)
+	fmt.Printf("    aws-aliased-profiles fetch --endpoint-url %s --sso-start-url %s --sso-region %s\n\n", s.URL, fetchtest.SSOStartURL, fetchtest.SSORegion)
+
+	sCh := make(chan os.Signal, 1)
+	signal.Notify(sCh, syscall.SIGINT, syscall.SIGTERM)
+	<-sCh
+
+	for _, op := range s.Operations() {
+		fmt.Printf("%-34s %d calls\n", op, s.Calls(op))
+	}
+}
+
+// writeConfig writes a shared config file with a fetchtest profile and
+// returns its path.
+func writeConfig() (path string, err error) {
+	f, err := ioutil.TempFile("", "fakeaws-config-")
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	_, err = fmt.Fprint(f, `[profile fetchtest]
+aws_access_key_id = fetchtest
+aws_secret_access_key = fetchtest
+region = us-east-1
+`)
+
+	return f.Name(), err
+}
@@ -0,0 +1,258 @@
+package fetchtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/logston/aws-aliased-profiles/common"
+)
+
+// organizationsRequest holds the members of every Organizations request the
+// server understands.
+type organizationsRequest struct {
+	ParentId             string
+	ChildId              string
+	ResourceId           string
+	OrganizationalUnitId string
+	MaxResults           int
+	NextToken            string
+}
+
+type jsonError struct {
+	Type    string `json:"__type"`
+	Message string `json:"message"`
+}
+
+type jsonTag struct {
+	Key   string
+	Value string
+}
+
+type jsonParent struct {
+	Id   string
+	Type string
+}
+
+func (s *Server) serveOrganizations(w http.ResponseWriter, r *http.Request, op string) {
+	var in organizationsRequest
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "SerializationException", err.Error())
+		return
+	}
+
+	if s.call(op) {
+		writeJSONError(w, http.StatusBadRequest, "TooManyRequestsException", "AWS Organizations can't complete your request because another request is already in progress. Try again later.")
+		return
+	}
+
+	var out interface{}
+	var ok bool
+	switch op {
+	case "DescribeOrganization":
+		out, ok = s.describeOrganization(), true
+	case "ListRoots":
+		out, ok = s.listRoots(in), true
+	case "ListAccounts":
+		out, ok = s.listAccounts(in), true
+	case "ListAccountsForParent":
+		out, ok = s.listAccountsForParent(in)
+	case "ListOrganizationalUnitsForParent":
+		out, ok = s.listOrganizationalUnitsForParent(in)
+	case "DescribeOrganizationalUnit":
+		out, ok = s.describeOrganizationalUnit(in)
+	case "ListParents":
+		out, ok = s.listParents(in)
+	case "ListTagsForResource":
+		if s.isDenied(op, in.ResourceId) {
+			writeJSONError(w, http.StatusBadRequest, "AccessDeniedException", fmt.Sprintf("You don't have permissions to access the tags of %s.", in.ResourceId))
+			return
+		}
+		out, ok = s.listTagsForResource(in)
+	default:
+		writeJSONError(w, http.StatusBadRequest, "UnknownOperationException", fmt.Sprintf("fetchtest does not implement %s", op))
+		return
+	}
+
+	if !ok {
+		writeJSONError(w, http.StatusBadRequest, "TargetNotFoundException", "We can't find a root, OU, account, or policy with the TargetId that you specified.")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	w.Header().Set("X-Amzn-Requestid", fmt.Sprintf("fetchtest-%d", s.requestId))
+	json.NewEncoder(w).Encode(out)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(jsonError{Type: code, Message: message})
+}
+
+func (s *Server) describeOrganization() interface{} {
+	return map[string]interface{}{
+		"Organization": map[string]interface{}{
+			"Id":                 OrganizationId,
+			"Arn":                fmt.Sprintf("arn:aws:organizations::%s:organization/%s", MasterAccountId, OrganizationId),
+			"FeatureSet":         "ALL",
+			"MasterAccountId":    MasterAccountId,
+			"MasterAccountArn":   s.accountArn(MasterAccountId),
+			"MasterAccountEmail": fmt.Sprintf("aws+%s@example.com", MasterAccountId),
+		},
+	}
+}
+
+func (s *Server) listRoots(in organizationsRequest) interface{} {
+	start, end, next := s.page(len(s.roots), in.NextToken, in.MaxResults)
+
+	roots := make([]interface{}, 0, end-start)
+	for _, root := range s.roots[start:end] {
+		roots = append(roots, map[string]interface{}{
+			"Id":   root.Id,
+			"Name": root.Name,
+			"Arn":  s.ouArn(root.Id),
+		})
+	}
+
+	return withNextToken(map[string]interface{}{"Roots": roots}, next)
+}
+
+func (s *Server) listAccounts(in organizationsRequest) interface{} {
+	var ids []string
+	for _, root := range s.roots {
+		ids = append(ids, s.descendantAccounts(root.Id)...)
+	}
+
+	return s.accountsPage(ids, in)
+}
+
+// descendantAccounts returns the IDs of the accounts beneath the root or
+// organizational unit, depth first in the order they were added.
+func (s *Server) descendantAccounts(parentId string) []string {
+	ids := append([]string(nil), s.childAccounts[parentId]...)
+	for _, id := range s.childOUs[parentId] {
+		ids = append(ids, s.descendantAccounts(id)...)
+	}
+
+	return ids
+}
+
+func (s *Server) listAccountsForParent(in organizationsRequest) (interface{}, bool) {
+	if _, ok := s.ous[in.ParentId]; !ok {
+		return nil, false
+	}
+
+	return s.accountsPage(s.childAccounts[in.ParentId], in), true
+}
+
+func (s *Server) accountsPage(ids []string, in organizationsRequest) interface{} {
+	start, end, next := s.page(len(ids), in.NextToken, in.MaxResults)
+
+	accounts := make([]interface{}, 0, end-start)
+	for _, id := range ids[start:end] {
+		a := s.accounts[id]
+		accounts = append(accounts, map[string]interface{}{
+			"Id":              a.Id,
+			"Arn":             s.accountArn(a.Id),
+			"Name":            a.Name,
+			"Email":           a.Email,
+			"Status":          a.Status,
+			"JoinedMethod":    "CREATED",
+			"JoinedTimestamp": float64(a.JoinedTimestamp.UnixNano()) / 1e9,
+		})
+	}
+
+	return withNextToken(map[string]interface{}{"Accounts": accounts}, next)
+}
+
+func (s *Server) listOrganizationalUnitsForParent(in organizationsRequest) (interface{}, bool) {
+	if _, ok := s.ous[in.ParentId]; !ok {
+		return nil, false
+	}
+
+	ids := s.childOUs[in.ParentId]
+	start, end, next := s.page(len(ids), in.NextToken, in.MaxResults)
+
+	ous := make([]interface{}, 0, end-start)
+	for _, id := range ids[start:end] {
+		ous = append(ous, s.describeOU(s.ous[id]))
+	}
+
+	return withNextToken(map[string]interface{}{"OrganizationalUnits": ous}, next), true
+}
+
+func (s *Server) describeOrganizationalUnit(in organizationsRequest) (interface{}, bool) {
+	o, ok := s.ous[in.OrganizationalUnitId]
+	if !ok || strings.HasPrefix(o.Id, "r-") {
+		return nil, false
+	}
+
+	return map[string]interface{}{"OrganizationalUnit": s.describeOU(o)}, true
+}
+
+func (s *Server) describeOU(o *ou) interface{} {
+	return map[string]interface{}{
+		"Id":   o.Id,
+		"Name": o.Name,
+		"Arn":  s.ouArn(o.Id),
+	}
+}
+
+func (s *Server) listParents(in organizationsRequest) (interface{}, bool) {
+	parentId, ok := s.parents[in.ChildId]
+	if !ok {
+		return nil, false
+	}
+
+	parentType := "ORGANIZATIONAL_UNIT"
+	if strings.HasPrefix(parentId, "r-") {
+		parentType = "ROOT"
+	}
+
+	return map[string]interface{}{
+		"Parents": []jsonParent{{Id: parentId, Type: parentType}},
+	}, true
+}
+
+func (s *Server) listTagsForResource(in organizationsRequest) (interface{}, bool) {
+	var tags []*common.Tag
+	if a, ok := s.accounts[in.ResourceId]; ok {
+		tags = a.Tags
+	} else if o, ok := s.ous[in.ResourceId]; ok {
+		tags = o.Tags
+	} else {
+		return nil, false
+	}
+
+	start, end, next := s.page(len(tags), in.NextToken, in.MaxResults)
+
+	page := make([]jsonTag, 0, end-start)
+	for _, t := range tags[start:end] {
+		page = append(page, jsonTag{Key: t.Key, Value: t.Value})
+	}
+
+	return withNextToken(map[string]interface{}{"Tags": page}, next), true
+}
+
+func withNextToken(out map[string]interface{}, next string) map[string]interface{} {
+	if next != "" {
+		out["NextToken"] = next
+	}
+
+	return out
+}
+
+func (s *Server) accountArn(id string) string {
+	return fmt.Sprintf("arn:aws:organizations::%s:account/%s/%s", MasterAccountId, OrganizationId, id)
+}
+
+func (s *Server) ouArn(id string) string {
+	kind := "ou"
+	if strings.HasPrefix(id, "r-") {
+		kind = "root"
+	}
+
+	return fmt.Sprintf("arn:aws:organizations::%s:%s/%s/%s", MasterAccountId, kind, OrganizationId, id)
+}
@@ -0,0 +1,291 @@
+package fetchtest
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	iamNamespace = "https://iam.amazonaws.com/doc/2010-05-08/"
+	stsNamespace = "https://sts.amazonaws.com/doc/2011-06-15/"
+)
+
+var (
+	credentialPattern = regexp.MustCompile(`Credential=([^/]+)/`)
+	roleArnPattern    = regexp.MustCompile(`^arn:[^:]+:iam::(\d{12}):role/(.+)$`)
+)
+
+// assumedRole is a role session handed out by AssumeRole.
+type assumedRole struct {
+	AccountId string
+	Role      string
+}
+
+type xmlError struct {
+	XMLName   xml.Name `xml:"ErrorResponse"`
+	Type      string   `xml:"Error>Type"`
+	Code      string   `xml:"Error>Code"`
+	Message   string   `xml:"Error>Message"`
+	RequestId string   `xml:"RequestId"`
+}
+
+type responseMetadata struct {
+	RequestId string
+}
+
+type assumeRoleResponse struct {
+	XMLName          xml.Name           `xml:"AssumeRoleResponse"`
+	Xmlns            string             `xml:"xmlns,attr"`
+	Credentials      xmlCredentials     `xml:"AssumeRoleResult>Credentials"`
+	AssumedRoleUser  xmlAssumedRoleUser `xml:"AssumeRoleResult>AssumedRoleUser"`
+	ResponseMetadata responseMetadata
+}
+
+type xmlCredentials struct {
+	AccessKeyId     string
+	SecretAccessKey string
+	SessionToken    string
+	Expiration      string
+}
+
+type xmlAssumedRoleUser struct {
+	Arn           string
+	AssumedRoleId string
+}
+
+type listAccountAliasesResponse struct {
+	XMLName          xml.Name `xml:"ListAccountAliasesResponse"`
+	Xmlns            string   `xml:"xmlns,attr"`
+	AccountAliases   []string `xml:"ListAccountAliasesResult>AccountAliases>member"`
+	IsTruncated      bool     `xml:"ListAccountAliasesResult>IsTruncated"`
+	ResponseMetadata responseMetadata
+}
+
+type listRolesResponse struct {
+	XMLName          xml.Name  `xml:"ListRolesResponse"`
+	Xmlns            string    `xml:"xmlns,attr"`
+	Roles            []xmlRole `xml:"ListRolesResult>Roles>member"`
+	IsTruncated      bool      `xml:"ListRolesResult>IsTruncated"`
+	Marker           string    `xml:"ListRolesResult>Marker,omitempty"`
+	ResponseMetadata responseMetadata
+}
+
+type xmlRole struct {
+	Path       string
+	RoleName   string
+	RoleId     string
+	Arn        string
+	CreateDate string
+}
+
+type listRoleTagsResponse struct {
+	XMLName          xml.Name `xml:"ListRoleTagsResponse"`
+	Xmlns            string   `xml:"xmlns,attr"`
+	Tags             []xmlTag `xml:"ListRoleTagsResult>Tags>member"`
+	IsTruncated      bool     `xml:"ListRoleTagsResult>IsTruncated"`
+	ResponseMetadata responseMetadata
+}
+
+type xmlTag struct {
+	Key   string
+	Value string
+}
+
+func (s *Server) serveQuery(w http.ResponseWriter, r *http.Request, action string) {
+	if s.call(action) {
+		s.writeXMLError(w, http.StatusBadRequest, "Throttling", "Rate exceeded")
+		return
+	}
+
+	switch action {
+	case "AssumeRole":
+		s.assumeRole(w, r)
+	case "ListAccountAliases":
+		s.listAccountAliases(w, r)
+	case "ListRoles":
+		s.listRoles(w, r)
+	case "ListRoleTags":
+		s.listRoleTags(w, r)
+	default:
+		s.writeXMLError(w, http.StatusBadRequest, "InvalidAction", fmt.Sprintf("fetchtest does not implement %s", action))
+	}
+}
+
+func (s *Server) assumeRole(w http.ResponseWriter, r *http.Request) {
+	roleArn := r.PostForm.Get("RoleArn")
+	m := roleArnPattern.FindStringSubmatch(roleArn)
+	if m == nil {
+		s.writeXMLError(w, http.StatusBadRequest, "ValidationError", fmt.Sprintf("%s is not a valid role ARN", roleArn))
+		return
+	}
+	accountId, role := m[1], m[2]
+
+	a, ok := s.accounts[accountId]
+	if ok {
+		_, ok = a.role(role)
+	}
+	if !ok || s.isDenied("AssumeRole", accountId, accountId+"/"+role, accountId+"/"+path.Base(role)) {
+		s.writeXMLError(w, http.StatusForbidden, "AccessDenied", fmt.Sprintf("User: arn:aws:iam::%s:user/fetchtest is not authorized to perform: sts:AssumeRole on resource: %s", MasterAccountId, roleArn))
+		return
+	}
+
+	key := fmt.Sprintf("ASIAFETCHTEST%07d", len(s.keys)+1)
+	s.keys[key] = assumedRole{AccountId: accountId, Role: role}
+
+	sessionName := r.PostForm.Get("RoleSessionName")
+	s.writeXML(w, &assumeRoleResponse{
+		Xmlns: stsNamespace,
+		Credentials: xmlCredentials{
+			AccessKeyId:     key,
+			SecretAccessKey: "fetchtest",
+			SessionToken:    "fetchtest",
+			Expiration:      time.Now().Add(time.Hour).UTC().Format(time.RFC3339),
+		},
+		AssumedRoleUser: xmlAssumedRoleUser{
+			Arn:           fmt.Sprintf("arn:aws:sts::%s:assumed-role/%s/%s", accountId, path.Base(role), sessionName),
+			AssumedRoleId: fmt.Sprintf("AROAFETCHTEST:%s", sessionName),
+		},
+		ResponseMetadata: responseMetadata{RequestId: s.requestIdString()},
+	})
+}
+
+func (s *Server) listAccountAliases(w http.ResponseWriter, r *http.Request) {
+	accountId, ok := s.callerAccount(r)
+	if !ok {
+		s.writeXMLError(w, http.StatusForbidden, "InvalidClientTokenId", "The security token included in the request is invalid.")
+		return
+	}
+
+	if s.isDenied("ListAccountAliases", accountId) {
+		s.writeXMLError(w, http.StatusForbidden, "AccessDenied", fmt.Sprintf("User: arn:aws:sts::%s:assumed-role/fetchtest is not authorized to perform: iam:ListAccountAliases", accountId))
+		return
+	}
+
+	var aliases []string
+	if a := s.accounts[accountId]; a != nil && a.Alias != "" {
+		aliases = []string{a.Alias}
+	}
+
+	s.writeXML(w, &listAccountAliasesResponse{
+		Xmlns:            iamNamespace,
+		AccountAliases:   aliases,
+		ResponseMetadata: responseMetadata{RequestId: s.requestIdString()},
+	})
+}
+
+func (s *Server) listRoles(w http.ResponseWriter, r *http.Request) {
+	accountId, ok := s.callerAccount(r)
+	if !ok {
+		s.writeXMLError(w, http.StatusForbidden, "InvalidClientTokenId", "The security token included in the request is invalid.")
+		return
+	}
+
+	if s.isDenied("ListRoles", accountId) {
+		s.writeXMLError(w, http.StatusForbidden, "AccessDenied", fmt.Sprintf("User: arn:aws:sts::%s:assumed-role/fetchtest is not authorized to perform: iam:ListRoles", accountId))
+		return
+	}
+
+	pathPrefix := r.PostForm.Get("PathPrefix")
+	if pathPrefix == "" {
+		pathPrefix = "/"
+	}
+
+	var roles []*Role
+	for _, role := range s.accounts[accountId].Roles {
+		if strings.HasPrefix(role.Path, pathPrefix) {
+			roles = append(roles, role)
+		}
+	}
+
+	var maxItems int
+	fmt.Sscanf(r.PostForm.Get("MaxItems"), "%d", &maxItems)
+	start, end, next := s.page(len(roles), r.PostForm.Get("Marker"), maxItems)
+
+	out := &listRolesResponse{
+		Xmlns:            iamNamespace,
+		IsTruncated:      next != "",
+		Marker:           next,
+		ResponseMetadata: responseMetadata{RequestId: s.requestIdString()},
+	}
+	for _, role := range roles[start:end] {
+		out.Roles = append(out.Roles, xmlRole{
+			Path:       role.Path,
+			RoleName:   role.Name,
+			RoleId:     "AROAFETCHTEST" + strings.ToUpper(role.Name),
+			Arn:        fmt.Sprintf("arn:aws:iam::%s:role%s%s", accountId, role.Path, role.Name),
+			CreateDate: "2020-01-01T00:00:00Z",
+		})
+	}
+
+	s.writeXML(w, out)
+}
+
+func (s *Server) listRoleTags(w http.ResponseWriter, r *http.Request) {
+	accountId, ok := s.callerAccount(r)
+	if !ok {
+		s.writeXMLError(w, http.StatusForbidden, "InvalidClientTokenId", "The security token included in the request is invalid.")
+		return
+	}
+
+	name := r.PostForm.Get("RoleName")
+	role, ok := s.accounts[accountId].role(name)
+	if !ok || role == nil {
+		s.writeXMLError(w, http.StatusNotFound, "NoSuchEntity", fmt.Sprintf("The role with name %s cannot be found.", name))
+		return
+	}
+
+	out := &listRoleTagsResponse{
+		Xmlns:            iamNamespace,
+		ResponseMetadata: responseMetadata{RequestId: s.requestIdString()},
+	}
+	for _, t := range role.Tags {
+		out.Tags = append(out.Tags, xmlTag{Key: t.Key, Value: t.Value})
+	}
+
+	s.writeXML(w, out)
+}
+
+// callerAccount returns the account of the credentials that signed r, which
+// must have been handed out by AssumeRole.
+func (s *Server) callerAccount(r *http.Request) (accountId string, ok bool) {
+	m := credentialPattern.FindStringSubmatch(r.Header.Get("Authorization"))
+	if m == nil {
+		return "", false
+	}
+
+	session, ok := s.keys[m[1]]
+	return session.AccountId, ok
+}
+
+func (s *Server) writeXML(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "text/xml")
+	w.Header().Set("X-Amzn-Requestid", s.requestIdString())
+	fmt.Fprint(w, xml.Header)
+	xml.NewEncoder(w).Encode(v)
+}
+
+func (s *Server) writeXMLError(w http.ResponseWriter, status int, code, message string) {
+	errType := "Sender"
+	if status >= 500 {
+		errType = "Receiver"
+	}
+
+	w.Header().Set("Content-Type", "text/xml")
+	w.WriteHeader(status)
+	fmt.Fprint(w, xml.Header)
+	xml.NewEncoder(w).Encode(&xmlError{
+		Type:      errType,
+		Code:      code,
+		Message:   message,
+		RequestId: s.requestIdString(),
+	})
+}
+
+func (s *Server) requestIdString() string {
+	return fmt.Sprintf("fetchtest-%d", s.requestId)
+}
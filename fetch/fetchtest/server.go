@@ -0,0 +1,452 @@
+// Package fetchtest provides a local HTTP server that speaks enough of the
+// AWS Organizations, IAM, STS and IAM Identity Center portal APIs for fetch to
+// run against it.
+//
+// The server models a single organization of roots, organizational units and
+// accounts. Any of its calls can be made to fail with AccessDenied for chosen
+// accounts, or to be throttled a number of times, so that partial failures
+// and rate limit handling can be exercised deterministically:
+//
+//	s := fetchtest.NewServer()
+//	defer s.Close()
+//
+//	ou := s.AddOU(s.RootId(), "Workloads")
+//	s.AddAccount(ou, &fetchtest.Account{Id: "111111111111", Name: "Prod", Alias: "acme-prod"})
+//	s.DenyAssumeRole("111111111111")
+//	s.Throttle("ListAccountsForParent", 3)
+//
+// and then point fetch at s.URL with --endpoint-url.
+package fetchtest
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/logston/aws-aliased-profiles/common"
+)
+
+const (
+	// DefaultPageSize is the most accounts, organizational units or tags the
+	// server returns in a page unless the client asks for fewer.
+	DefaultPageSize = 20
+
+	OrganizationId  = "o-fetchtest"
+	MasterAccountId = "000000000000"
+	RootId          = "r-test"
+)
+
+// Account is an account in the organization of a Server.
+type Account struct {
+	Id              string
+	Name            string
+	Email           string
+	Status          string
+	JoinedTimestamp time.Time
+	Alias           string
+	Tags            []*common.Tag
+
+	// The IAM roles in the account. When empty, every role exists in the
+	// account and may be assumed, but none are listed.
+	Roles []*Role
+}
+
+// Role is an IAM role in an account of a Server.
+type Role struct {
+	// The path of the role, "/" when empty.
+	Path string
+	Name string
+	Tags []*common.Tag
+}
+
+// role returns the role of the account with the given name, optionally
+// preceded by its path, and whether it exists.
+func (a *Account) role(name string) (*Role, bool) {
+	if len(a.Roles) == 0 {
+		return nil, true
+	}
+
+	for _, r := range a.Roles {
+		if name == r.Name || "/"+name == r.Path+r.Name {
+			return r, true
+		}
+	}
+
+	return nil, false
+}
+
+type ou struct {
+	Id   string
+	Name string
+	Tags []*common.Tag
+}
+
+// Server is a fake AWS endpoint for Organizations, IAM and STS. It is safe
+// for concurrent use.
+type Server struct {
+	*httptest.Server
+
+	mu sync.Mutex
+
+	pageSize int
+
+	roots    []*ou
+	ous      map[string]*ou
+	accounts map[string]*Account
+
+	// The organizational units and accounts directly beneath each root or
+	// organizational unit, in the order they were added, and the parent of
+	// each organizational unit and account.
+	childOUs      map[string][]string
+	childAccounts map[string][]string
+	parents       map[string]string
+
+	// The role session each access key handed out by AssumeRole belongs to.
+	keys map[string]assumedRole
+
+	// Account IDs, optionally followed by "/" and a role name, for which
+	// each operation is denied.
+	denied map[string]map[string]bool
+
+	// The number of upcoming calls to each operation to throttle.
+	throttled map[string]int
+
+	calls map[string]int
+
+	requestId int
+
+	// How long each request takes, like the round trip to AWS.
+	latency time.Duration
+}
+
+// NewServer starts a server whose organization has a single, empty root.
+// The caller should call Close when finished, to shut it down.
+func NewServer() *Server {
+	s := &Server{
+		pageSize:      DefaultPageSize,
+		ous:           make(map[string]*ou),
+		accounts:      make(map[string]*Account),
+		childOUs:      make(map[string][]string),
+		childAccounts: make(map[string][]string),
+		parents:       make(map[string]string),
+		keys:          make(map[string]assumedRole),
+		denied:        make(map[string]map[string]bool),
+		throttled:     make(map[string]int),
+		calls:         make(map[string]int),
+	}
+
+	root := &ou{Id: RootId, Name: "Root"}
+	s.roots = []*ou{root}
+	s.ous[root.Id] = root
+
+	s.Server = httptest.NewServer(s)
+
+	return s
+}
+
+// RootId returns the ID of the root of the organization.
+func (s *Server) RootId() string {
+	return RootId
+}
+
+// SetLatency delays the response to every request by d, like the round trip
+// to AWS, so that fetching from the server takes about as long as the
+// requests it makes, e.g. when benchmarking.
+func (s *Server) SetLatency(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.latency = d
+}
+
+// SetPageSize sets the most items returned in a page.
+func (s *Server) SetPageSize(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pageSize = n
+}
+
+// AddOU adds an organizational unit with the given name beneath the root or
+// organizational unit parentId and returns its ID.
+func (s *Server) AddOU(parentId, name string, tags ...*common.Tag) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.mustExist(parentId)
+
+	o := &ou{
+		Id:   fmt.Sprintf("ou-test-%08d", len(s.ous)),
+		Name: name,
+		Tags: tags,
+	}
+	s.ous[o.Id] = o
+	s.childOUs[parentId] = append(s.childOUs[parentId], o.Id)
+	s.parents[o.Id] = parentId
+
+	return o.Id
+}
+
+// AddAccount adds a to the organization beneath the root or organizational
+// unit parentId. Status defaults to ACTIVE and Email and JoinedTimestamp are
+// made up when empty.
+func (s *Server) AddAccount(parentId string, a *Account) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.mustExist(parentId)
+	if _, ok := s.accounts[a.Id]; ok {
+		panic(fmt.Sprintf("fetchtest: account %s added twice", a.Id))
+	}
+
+	if a.Status == "" {
+		a.Status = "ACTIVE"
+	}
+	if a.Email == "" {
+		a.Email = fmt.Sprintf("aws+%s@example.com", a.Id)
+	}
+	if a.JoinedTimestamp.IsZero() {
+		a.JoinedTimestamp = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	for _, r := range a.Roles {
+		if r.Path == "" {
+			r.Path = "/"
+		}
+	}
+
+	s.accounts[a.Id] = a
+	s.childAccounts[parentId] = append(s.childAccounts[parentId], a.Id)
+	s.parents[a.Id] = parentId
+}
+
+func (s *Server) mustExist(parentId string) {
+	if _, ok := s.ous[parentId]; !ok {
+		panic(fmt.Sprintf("fetchtest: no root or organizational unit %s", parentId))
+	}
+}
+
+// DenyAssumeRole makes AssumeRole fail with AccessDenied for the given roles
+// in the account, or for every role when none are given.
+func (s *Server) DenyAssumeRole(accountId string, roles ...string) {
+	if len(roles) == 0 {
+		s.deny("AssumeRole", accountId)
+	}
+	for _, role := range roles {
+		s.deny("AssumeRole", accountId+"/"+role)
+	}
+}
+
+// DenyListAliases makes ListAccountAliases fail with AccessDenied in the
+// account.
+func (s *Server) DenyListAliases(accountId string) {
+	s.deny("ListAccountAliases", accountId)
+}
+
+// DenyListRoles makes ListRoles fail with AccessDenied in the account.
+func (s *Server) DenyListRoles(accountId string) {
+	s.deny("ListRoles", accountId)
+}
+
+// DenyListTags makes ListTagsForResource fail with AccessDenied for the
+// account, root or organizational unit.
+func (s *Server) DenyListTags(resourceId string) {
+	s.deny("ListTagsForResource", resourceId)
+}
+
+// TagResource replaces the tags of the account, root or organizational unit.
+func (s *Server) TagResource(resourceId string, tags ...*common.Tag) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if a, ok := s.accounts[resourceId]; ok {
+		a.Tags = tags
+	} else if o, ok := s.ous[resourceId]; ok {
+		o.Tags = tags
+	} else {
+		panic(fmt.Sprintf("fetchtest: no account, root or organizational unit %s", resourceId))
+	}
+}
+
+func (s *Server) deny(op, resource string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.denied[op] == nil {
+		s.denied[op] = make(map[string]bool)
+	}
+	s.denied[op][resource] = true
+}
+
+func (s *Server) isDenied(op string, resources ...string) bool {
+	for _, r := range resources {
+		if s.denied[op][r] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Throttle makes the next n calls to the operation, e.g. "ListTagsForResource"
+// or "AssumeRole", fail with the throttling error of its API.
+func (s *Server) Throttle(op string, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.throttled[op] += n
+}
+
+// Calls returns the number of calls made to the operation, including those
+// that failed.
+func (s *Server) Calls(op string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.calls[op]
+}
+
+// Operations returns the names of the operations called so far, sorted.
+func (s *Server) Operations() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ops := make([]string, 0, len(s.calls))
+	for op := range s.calls {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+
+	return ops
+}
+
+// call records a call to op and reports whether it should be throttled.
+func (s *Server) call(op string) (throttle bool) {
+	s.calls[op]++
+	s.requestId++
+
+	if s.throttled[op] > 0 {
+		s.throttled[op]--
+		return true
+	}
+
+	return false
+}
+
+// ServeHTTP dispatches IAM Identity Center portal requests, which name their
+// operation in the path, Organizations requests, which name it in the
+// X-Amz-Target header, and IAM and STS requests, which name it in the Action
+// form value.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Requests wait out the latency concurrently, as they would for AWS.
+	s.mu.Lock()
+	latency := s.latency
+	s.mu.Unlock()
+	time.Sleep(latency)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if strings.HasPrefix(r.URL.Path, "/assignment/") {
+		s.serveSSO(w, r)
+		return
+	}
+
+	if target := r.Header.Get("X-Amz-Target"); target != "" {
+		op := target[strings.LastIndex(target, ".")+1:]
+		s.serveOrganizations(w, r, op)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.serveQuery(w, r, r.PostForm.Get("Action"))
+}
+
+// page returns the bounds of the page of n items starting at nextToken, and
+// the token of the following page, if any.
+func (s *Server) page(n int, nextToken string, maxResults int) (start, end int, next string) {
+	size := s.pageSize
+	if maxResults > 0 && maxResults < size {
+		size = maxResults
+	}
+
+	if nextToken != "" {
+		fmt.Sscanf(nextToken, "%d", &start)
+	}
+	if start > n {
+		start = n
+	}
+
+	end = start + size
+	if end >= n {
+		return start, n, ""
+	}
+
+	return start, end, fmt.Sprintf("%d", end)
+}
+
+// Generate adds n accounts spread evenly across ous organizational units
+// beneath the root, or directly beneath the root when ous is zero, and
+// returns their IDs. Every account has a name, an alias and an environment
+// tag derived from its position, which overrides the environment tag on the
+// root. Every organizational unit has a cost-center tag.
+func (s *Server) Generate(n, ous int) (ids []string) {
+	s.TagResource(RootId, &common.Tag{Key: "environment", Value: "sandbox"})
+
+	parents := []string{RootId}
+	if ous > 0 {
+		parents = parents[:0]
+		for i := 0; i < ous; i++ {
+			parents = append(parents, s.AddOU(RootId, fmt.Sprintf("OU %d", i+1), &common.Tag{
+				Key:   "cost-center",
+				Value: fmt.Sprintf("cc-%d", i+1),
+			}))
+		}
+	}
+
+	for i := 0; i < n; i++ {
+		env := "production"
+		if i%2 == 1 {
+			env = "staging"
+		}
+
+		a := &Account{
+			Id:    fmt.Sprintf("%012d", 100000000000+i+1),
+			Name:  fmt.Sprintf("Account %d", i+1),
+			Alias: fmt.Sprintf("account-%d", i+1),
+			Tags:  []*common.Tag{{Key: "environment", Value: env}},
+		}
+		s.AddAccount(parents[i%len(parents)], a)
+		ids = append(ids, a.Id)
+	}
+
+	return
+}
+
+// SetRoles replaces the roles of the account with roles of the given names,
+// each optionally preceded by a path, e.g. "Admin" or "team/ReadOnly".
+func (s *Server) SetRoles(accountId string, names ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a, ok := s.accounts[accountId]
+	if !ok {
+		panic(fmt.Sprintf("fetchtest: no account %s", accountId))
+	}
+
+	a.Roles = nil
+	for _, name := range names {
+		i := strings.LastIndex(name, "/")
+		a.Roles = append(a.Roles, &Role{
+			Path: "/" + strings.TrimPrefix(name[:i+1], "/"),
+			Name: name[i+1:],
+		})
+	}
+}
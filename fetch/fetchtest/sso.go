@@ -0,0 +1,135 @@
+package fetchtest
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+const (
+	// SSOAccessToken is the only access token the IAM Identity Center portal
+	// of a Server accepts.
+	SSOAccessToken = "fetchtest-sso-token"
+
+	SSOStartURL = "https://fetchtest.awsapps.com/start"
+	SSORegion   = "us-east-1"
+)
+
+// WriteSSOToken caches SSOAccessToken in home/.aws/sso/cache, the way aws sso
+// login does, as the token of the portal with the given start URL or of the
+// sso-session with the given name.
+func WriteSSOToken(home, startURLOrSession string) error {
+	dir := filepath.Join(home, ".aws", "sso", "cache")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(map[string]string{
+		"startUrl":    SSOStartURL,
+		"region":      SSORegion,
+		"accessToken": SSOAccessToken,
+		"expiresAt":   time.Now().Add(24 * time.Hour).UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		return err
+	}
+
+	sum := sha1.Sum([]byte(startURLOrSession))
+
+	return ioutil.WriteFile(filepath.Join(dir, hex.EncodeToString(sum[:])+".json"), data, 0600)
+}
+
+type ssoAccount struct {
+	AccountId    string `json:"accountId"`
+	AccountName  string `json:"accountName"`
+	EmailAddress string `json:"emailAddress"`
+}
+
+type ssoRole struct {
+	AccountId string `json:"accountId"`
+	RoleName  string `json:"roleName"`
+}
+
+// serveSSO serves the ListAccounts and ListAccountRoles operations of the
+// IAM Identity Center portal, recorded as "sso.ListAccounts" and
+// "sso.ListAccountRoles" so as not to be mistaken for the operations of
+// Organizations. Every account of the organization is assigned to the user,
+// with the names of its roles as the roles assigned in it.
+func (s *Server) serveSSO(w http.ResponseWriter, r *http.Request) {
+	var op string
+	switch r.URL.Path {
+	case "/assignment/accounts":
+		op = "sso.ListAccounts"
+	case "/assignment/roles":
+		op = "sso.ListAccountRoles"
+	default:
+		writeRESTError(w, http.StatusNotFound, "ResourceNotFoundException", fmt.Sprintf("fetchtest does not implement %s", r.URL.Path))
+		return
+	}
+
+	if s.call(op) {
+		writeRESTError(w, http.StatusTooManyRequests, "TooManyRequestsException", "Rate exceeded")
+		return
+	}
+
+	if r.Header.Get("X-Amz-Sso_bearer_token") != SSOAccessToken {
+		writeRESTError(w, http.StatusUnauthorized, "UnauthorizedException", "Session token not found or invalid")
+		return
+	}
+
+	q := r.URL.Query()
+	maxResults, _ := strconv.Atoi(q.Get("max_result"))
+
+	var out map[string]interface{}
+	switch op {
+	case "sso.ListAccounts":
+		var ids []string
+		for _, root := range s.roots {
+			ids = append(ids, s.descendantAccounts(root.Id)...)
+		}
+
+		start, end, next := s.page(len(ids), q.Get("next_token"), maxResults)
+		accounts := make([]ssoAccount, 0, end-start)
+		for _, id := range ids[start:end] {
+			a := s.accounts[id]
+			accounts = append(accounts, ssoAccount{AccountId: a.Id, AccountName: a.Name, EmailAddress: a.Email})
+		}
+		out = map[string]interface{}{"accountList": accounts}
+		if next != "" {
+			out["nextToken"] = next
+		}
+	case "sso.ListAccountRoles":
+		a, ok := s.accounts[q.Get("account_id")]
+		if !ok {
+			writeRESTError(w, http.StatusNotFound, "ResourceNotFoundException", "The account is not assigned to the user")
+			return
+		}
+
+		start, end, next := s.page(len(a.Roles), q.Get("next_token"), maxResults)
+		roles := make([]ssoRole, 0, end-start)
+		for _, role := range a.Roles[start:end] {
+			roles = append(roles, ssoRole{AccountId: a.Id, RoleName: role.Name})
+		}
+		out = map[string]interface{}{"roleList": roles}
+		if next != "" {
+			out["nextToken"] = next
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+func writeRESTError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Amzn-Errortype", code)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"message": message})
+}
@@ -0,0 +1,73 @@
+package fetch
+
+import (
+	"time"
+
+	"github.com/logston/aws-aliased-profiles/common"
+)
+
+// Reuse copies the tags and alias, along with the roles discovered with the
+// alias, fetched previously into accounts as they are listed, so that only
+// missing or stale data is fetched again.
+type Reuse struct {
+	byId     map[string]*common.Account
+	tagsTTL  time.Duration
+	aliasTTL time.Duration
+	now      time.Time
+
+	// Whether stale data is copied too, so that it survives a failed
+	// refresh.
+	copyStale bool
+}
+
+// NewReuse returns a Reuse of the tags and aliases of prev which are younger
+// than tagsTTL and aliasTTL respectively. When copyStale is true, older tags
+// and aliases are copied as well but still reported as needing a fetch.
+func NewReuse(prev []*common.Account, tagsTTL, aliasTTL time.Duration, copyStale bool) *Reuse {
+	byId := make(map[string]*common.Account, len(prev))
+	for _, p := range prev {
+		byId[p.Id] = p
+	}
+
+	return &Reuse{
+		byId:      byId,
+		tagsTTL:   tagsTTL,
+		aliasTTL:  aliasTTL,
+		now:       time.Now(),
+		copyStale: copyStale,
+	}
+}
+
+// Apply copies the tags and alias of the matching previous account into a
+// and reports whether the tags and the alias of a still need to be fetched.
+// New accounts need both.
+func (r *Reuse) Apply(a *common.Account) (needTags, needAlias bool) {
+	p, ok := r.byId[a.Id]
+	if !ok {
+		return true, true
+	}
+
+	needTags = !isFresh(p.FetchedAt.Tags, r.tagsTTL, r.now)
+	if !needTags || r.copyStale {
+		a.Tags = p.Tags
+		a.FetchedAt.Tags = p.FetchedAt.Tags
+		a.FetchOutcome.Tags = p.FetchOutcome.Tags
+	}
+
+	needAlias = !isFresh(p.FetchedAt.Alias, r.aliasTTL, r.now)
+	if !needAlias || r.copyStale {
+		a.Alias = p.Alias
+		a.AssumableRole = p.AssumableRole
+		a.FetchedAt.Alias = p.FetchedAt.Alias
+		a.FetchOutcome.Alias = p.FetchOutcome.Alias
+		a.Roles = p.Roles
+		a.FetchedAt.Roles = p.FetchedAt.Roles
+		a.FetchOutcome.Roles = p.FetchOutcome.Roles
+	}
+
+	return
+}
+
+func isFresh(fetchedAt time.Time, ttl time.Duration, now time.Time) bool {
+	return !fetchedAt.IsZero() && now.Sub(fetchedAt) < ttl
+}
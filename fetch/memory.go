@@ -0,0 +1,154 @@
+package fetch
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/logston/aws-aliased-profiles/common"
+)
+
+// MemorySource is an AccountSource backed by a list of accounts held in
+// memory, e.g. to try templates and upsert without access to AWS or to test
+// fetching.
+type MemorySource struct {
+	// The organization of the accounts. An empty organization is used when
+	// nil.
+	Org *common.Organization
+
+	// The accounts of the organization along with their tags and aliases.
+	Accounts []*common.Account
+
+	// The number of accounts listed per page. 20, like Organizations, when
+	// zero.
+	PageSize int
+
+	// How long listing a page and fetching the tags and alias of an account
+	// take.
+	ListLatency  time.Duration
+	TagsLatency  time.Duration
+	AliasLatency time.Duration
+
+	// Errors recorded as the outcome of fetching the tags or alias of the
+	// account with the given ID instead of fetching them.
+	TagsErrors  map[string]error
+	AliasErrors map[string]error
+
+	once sync.Once
+	byId map[string]*common.Account
+}
+
+// NewFileSource returns a MemorySource of the accounts in a JSON file in the
+// same shape as the state file, e.g. a state file copied from another machine.
+func NewFileSource(path string) (*MemorySource, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	al, err := common.ParseAccountList(data)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse %s: %v", path, err)
+	}
+
+	s := &MemorySource{Accounts: al}
+	if len(al) != 0 && al[0].Org != nil {
+		org := *al[0].Org
+		s.Org = &org
+	}
+
+	return s, nil
+}
+
+func (s *MemorySource) Organization(ctx context.Context) (*common.Organization, error) {
+	if s.Org == nil {
+		return &common.Organization{}, nil
+	}
+
+	org := *s.Org
+	return &org, nil
+}
+
+func (s *MemorySource) ListAccounts(ctx context.Context, emit func([]*common.Account) error) error {
+	pageSize := s.PageSize
+	if pageSize < 1 {
+		pageSize = int(*MaxResults)
+	}
+
+	for i := 0; i < len(s.Accounts); i += pageSize {
+		if err := sleep(ctx, s.ListLatency); err != nil {
+			return err
+		}
+
+		var page []*common.Account
+		for j := i; j < i+pageSize && j < len(s.Accounts); j++ {
+			a := s.Accounts[j]
+			page = append(page, &common.Account{
+				Id:              a.Id,
+				Name:            a.Name,
+				Email:           a.Email,
+				Arn:             a.Arn,
+				JoinedTimestamp: a.JoinedTimestamp,
+				Status:          a.Status,
+				OUs:             a.OUs,
+			})
+		}
+
+		if err := emit(page); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *MemorySource) Tags(ctx context.Context, a *common.Account) error {
+	if err := sleep(ctx, s.TagsLatency); err != nil {
+		return err
+	}
+
+	if err := s.TagsErrors[a.Id]; err != nil {
+		return recordFailure(ctx, &a.FetchOutcome.Tags, err, common.FetchListTagsDenied)
+	}
+
+	a.Tags = nil
+	if sa := s.account(a.Id); sa != nil {
+		a.Tags = sa.Tags
+	}
+	a.FetchedAt.Tags = time.Now()
+	a.FetchOutcome.Tags = common.FetchOutcome{Status: common.FetchOK}
+
+	return nil
+}
+
+func (s *MemorySource) Alias(ctx context.Context, a *common.Account) error {
+	if err := sleep(ctx, s.AliasLatency); err != nil {
+		return err
+	}
+
+	if err := s.AliasErrors[a.Id]; err != nil {
+		return recordFailure(ctx, &a.FetchOutcome.Alias, err, common.FetchAssumeRoleDenied)
+	}
+
+	a.Alias, a.AssumableRole, a.Roles = "", "", nil
+	if sa := s.account(a.Id); sa != nil {
+		a.Alias, a.AssumableRole, a.Roles = sa.Alias, sa.AssumableRole, sa.Roles
+	}
+	a.FetchedAt.Alias = time.Now()
+	a.FetchOutcome.Alias = common.FetchOutcome{Status: common.FetchOK}
+
+	return nil
+}
+
+func (s *MemorySource) account(id string) *common.Account {
+	s.once.Do(func() {
+		s.byId = make(map[string]*common.Account, len(s.Accounts))
+		for _, a := range s.Accounts {
+			s.byId[a.Id] = a
+		}
+	})
+
+	return s.byId[id]
+}
@@ -0,0 +1,295 @@
+package fetch
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/service/organizations"
+
+	"github.com/logston/aws-aliased-profiles/common"
+)
+
+// WalkAccounts walks the organization tree beneath each of ouIds,
+// recursively, and passes each page of accounts found, along with the path
+// from the root to the accounts, to emit. The tags of each root and
+// organizational unit on the path are fetched before its accounts are
+// emitted. Subtrees rooted at any of excludeIds are skipped. When ouIds is
+// empty, the walk starts at every root of the organization.
+func WalkAccounts(ctx context.Context, sess client.ConfigProvider, lim *Limiters, ouIds, excludeIds []string, emit func([]*common.Account) error) (err error) {
+	svc := organizations.New(sess)
+
+	var starts [][]*common.OrganizationalUnit
+	if len(ouIds) == 0 {
+		if starts, err = getRootPaths(ctx, svc, lim); err != nil {
+			return
+		}
+	} else {
+		for _, id := range ouIds {
+			var path []*common.OrganizationalUnit
+			if path, err = getOUPath(ctx, svc, lim, id); err != nil {
+				return
+			}
+			starts = append(starts, path)
+		}
+	}
+
+	exclude := make(map[string]bool)
+	for _, id := range excludeIds {
+		exclude[id] = true
+	}
+
+	w := &ouWalker{
+		svc:     svc,
+		lim:     lim,
+		exclude: exclude,
+		seen:    make(map[string]bool),
+		tags:    make(map[string][]*common.Tag),
+		tagsOut: make(map[string]common.FetchOutcome),
+		tagged:  make(map[*common.OrganizationalUnit]bool),
+		emit:    emit,
+	}
+
+	for _, path := range starts {
+		if w.isExcluded(path) {
+			continue
+		}
+
+		if err = w.walk(ctx, path); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+type ouWalker struct {
+	svc     *organizations.Organizations
+	lim     *Limiters
+	exclude map[string]bool
+	seen    map[string]bool
+	tags    map[string][]*common.Tag
+	tagsOut map[string]common.FetchOutcome
+	tagged  map[*common.OrganizationalUnit]bool
+	emit    func([]*common.Account) error
+}
+
+func (w *ouWalker) isExcluded(path []*common.OrganizationalUnit) bool {
+	for _, ou := range path {
+		if w.exclude[ou.Id] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// walk records every account directly beneath the last element of path and
+// then descends into each child organizational unit that is not excluded.
+func (w *ouWalker) walk(ctx context.Context, path []*common.OrganizationalUnit) (err error) {
+	parentId := path[len(path)-1].Id
+
+	// The same subtree is walked only once, even if it was asked for twice.
+	if w.seen[parentId] {
+		return
+	}
+	w.seen[parentId] = true
+
+	if err = w.tagPath(ctx, path); err != nil {
+		return
+	}
+
+	var ao *organizations.ListAccountsForParentOutput
+	var nextToken *string
+	for {
+		if err = common.CheckContext(ctx); err != nil {
+			return
+		}
+
+		err = w.lim.Organizations.Do(ctx, func() (e error) {
+			ao, e = w.svc.ListAccountsForParentWithContext(ctx, &organizations.ListAccountsForParentInput{
+				ParentId:   &parentId,
+				MaxResults: MaxResults,
+				NextToken:  nextToken,
+			})
+			return
+		})
+		if err != nil {
+			return
+		}
+
+		if err = w.emit(GetAccounts(ao.Accounts, path)); err != nil {
+			return
+		}
+
+		if ao.NextToken == nil {
+			break
+		}
+
+		nextToken = ao.NextToken
+	}
+
+	var oo *organizations.ListOrganizationalUnitsForParentOutput
+	nextToken = nil
+	for {
+		if err = common.CheckContext(ctx); err != nil {
+			return
+		}
+
+		err = w.lim.Organizations.Do(ctx, func() (e error) {
+			oo, e = w.svc.ListOrganizationalUnitsForParentWithContext(ctx, &organizations.ListOrganizationalUnitsForParentInput{
+				ParentId:   &parentId,
+				MaxResults: MaxResults,
+				NextToken:  nextToken,
+			})
+			return
+		})
+		if err != nil {
+			return
+		}
+
+		for _, ou := range oo.OrganizationalUnits {
+			// Copy the path so that siblings do not share a backing array.
+			childPath := make([]*common.OrganizationalUnit, len(path), len(path)+1)
+			copy(childPath, path)
+			childPath = append(childPath, &common.OrganizationalUnit{Id: *ou.Id, Name: *ou.Name})
+
+			if w.isExcluded(childPath) {
+				continue
+			}
+
+			if err = w.walk(ctx, childPath); err != nil {
+				return
+			}
+		}
+
+		if oo.NextToken == nil {
+			break
+		}
+
+		nextToken = oo.NextToken
+	}
+
+	return
+}
+
+// tagPath sets the tags of each root or organizational unit on path,
+// fetching those not fetched yet, along with the outcome of fetching them. An
+// organizational unit whose tags may not be listed is left without tags, so
+// that its accounts are still fetched.
+func (w *ouWalker) tagPath(ctx context.Context, path []*common.OrganizationalUnit) (err error) {
+	for _, ou := range path {
+		// Accounts beneath ou may already have been emitted, so ou is never
+		// written to twice.
+		if w.tagged[ou] {
+			continue
+		}
+		w.tagged[ou] = true
+
+		tags, ok := w.tags[ou.Id]
+		if !ok {
+			outcome := common.FetchOutcome{Status: common.FetchOK}
+			if tags, err = listTags(ctx, w.svc, w.lim, ou.Id); err != nil {
+				if err = recordFailure(ctx, &outcome, err, common.FetchListTagsDenied); err != nil {
+					return
+				}
+			}
+			w.tags[ou.Id] = tags
+			w.tagsOut[ou.Id] = outcome
+		}
+
+		ou.Tags = tags
+		ou.FetchOutcome = w.tagsOut[ou.Id]
+	}
+
+	return
+}
+
+// getRootPaths returns a single element path for each root of the
+// organization.
+func getRootPaths(ctx context.Context, svc *organizations.Organizations, lim *Limiters) (paths [][]*common.OrganizationalUnit, err error) {
+	var o *organizations.ListRootsOutput
+	var nextToken *string
+	for {
+		if err = common.CheckContext(ctx); err != nil {
+			return
+		}
+
+		err = lim.Organizations.Do(ctx, func() (e error) {
+			o, e = svc.ListRootsWithContext(ctx, &organizations.ListRootsInput{
+				MaxResults: MaxResults,
+				NextToken:  nextToken,
+			})
+			return
+		})
+		if err != nil {
+			return
+		}
+
+		for _, r := range o.Roots {
+			paths = append(paths, []*common.OrganizationalUnit{{Id: *r.Id, Name: *r.Name}})
+		}
+
+		if o.NextToken == nil {
+			break
+		}
+
+		nextToken = o.NextToken
+	}
+
+	return
+}
+
+// getOUPath returns the path from the root of the organization down to, and
+// including, the root or organizational unit with the given ID.
+func getOUPath(ctx context.Context, svc *organizations.Organizations, lim *Limiters, id string) (path []*common.OrganizationalUnit, err error) {
+	for !strings.HasPrefix(id, "r-") {
+		if err = common.CheckContext(ctx); err != nil {
+			return
+		}
+
+		var do *organizations.DescribeOrganizationalUnitOutput
+		err = lim.Organizations.Do(ctx, func() (e error) {
+			do, e = svc.DescribeOrganizationalUnitWithContext(ctx, &organizations.DescribeOrganizationalUnitInput{
+				OrganizationalUnitId: &id,
+			})
+			return
+		})
+		if err != nil {
+			return
+		}
+
+		path = append([]*common.OrganizationalUnit{
+			{Id: *do.OrganizationalUnit.Id, Name: *do.OrganizationalUnit.Name},
+		}, path...)
+
+		// An organizational unit has exactly one parent.
+		var po *organizations.ListParentsOutput
+		err = lim.Organizations.Do(ctx, func() (e error) {
+			po, e = svc.ListParentsWithContext(ctx, &organizations.ListParentsInput{ChildId: &id})
+			return
+		})
+		if err != nil {
+			return
+		}
+		if len(po.Parents) != 1 {
+			return nil, fmt.Errorf("Expected one parent for %s, found %d", id, len(po.Parents))
+		}
+
+		id = *po.Parents[0].Id
+	}
+
+	roots, err := getRootPaths(ctx, svc, lim)
+	if err != nil {
+		return
+	}
+
+	for _, root := range roots {
+		if root[0].Id == id {
+			return append(root, path...), nil
+		}
+	}
+
+	return nil, fmt.Errorf("Root %s not found in organization", id)
+}
@@ -0,0 +1,180 @@
+package fetch
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/logston/aws-aliased-profiles/common"
+)
+
+// Pipeline runs the stages of a fetch from a source concurrently. Each page of
+// accounts is handed to the tags and alias workers as soon as it is listed,
+// so the fetch takes about as long as its slowest stage rather than the sum
+// of all three.
+type Pipeline struct {
+	Source AccountSource
+
+	// The number of accounts whose tags and whose aliases are fetched at
+	// the same time.
+	TagsConcurrency  int
+	AliasConcurrency int
+
+	// Route is called with each account as it is listed, before it is handed
+	// to the workers, and reports whether its tags and its alias need to be
+	// fetched. Both are fetched for every account when nil.
+	Route func(a *common.Account) (needTags, needAlias bool)
+
+	// Called after the tags or the alias of an account were fetched.
+	TagsDone  func(a *common.Account)
+	AliasDone func(a *common.Account)
+
+	// Whether to print progress while running.
+	Progress bool
+}
+
+// Run runs the pipeline and returns the accounts in the order they were
+// listed.
+func (p *Pipeline) Run(ctx context.Context) (al []*common.Account, err error) {
+	eg, ctx := errgroup.WithContext(ctx)
+
+	tagsQ, aliasQ := newQueue(), newQueue()
+	var listed, tagged, aliased int64
+
+	eg.Go(func() error {
+		defer tagsQ.close()
+		defer aliasQ.close()
+
+		return p.Source.ListAccounts(ctx, func(page []*common.Account) error {
+			for _, a := range page {
+				needTags, needAlias := true, true
+				if p.Route != nil {
+					needTags, needAlias = p.Route(a)
+				}
+
+				al = append(al, a)
+				if needTags {
+					tagsQ.push(a)
+				}
+				if needAlias {
+					aliasQ.push(a)
+				}
+			}
+			atomic.AddInt64(&listed, int64(len(page)))
+
+			return common.CheckContext(ctx)
+		})
+	})
+
+	work := func(q *queue, concurrency int, fetch func(context.Context, *common.Account) error, done func(*common.Account), count *int64) {
+		if concurrency < 1 {
+			concurrency = 1
+		}
+
+		for i := 0; i < concurrency; i++ {
+			eg.Go(func() error {
+				for {
+					a, ok := q.pop()
+					if !ok {
+						return nil
+					}
+
+					if err := fetch(ctx, a); err != nil {
+						return err
+					}
+					if done != nil {
+						done(a)
+					}
+					atomic.AddInt64(count, 1)
+				}
+			})
+		}
+	}
+	work(tagsQ, p.TagsConcurrency, p.Source.Tags, p.TagsDone, &tagged)
+	work(aliasQ, p.AliasConcurrency, p.Source.Alias, p.AliasDone, &aliased)
+
+	printProgress := func() {
+		fmt.Printf("\rListed %d accounts, fetched tags for %d and aliases for %d...",
+			atomic.LoadInt64(&listed), atomic.LoadInt64(&tagged), atomic.LoadInt64(&aliased))
+	}
+
+	stop := make(chan struct{})
+	if p.Progress {
+		go func() {
+			t := time.NewTicker(200 * time.Millisecond)
+			defer t.Stop()
+			for {
+				select {
+				case <-stop:
+					return
+				case <-t.C:
+					printProgress()
+				}
+			}
+		}()
+	}
+
+	err = eg.Wait()
+	close(stop)
+
+	if p.Progress {
+		printProgress()
+		fmt.Println()
+	}
+
+	return
+}
+
+// queue is an unbounded FIFO of accounts feeding one stage of the pipeline,
+// so that a slow stage never holds up listing or the other stage.
+type queue struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	items  []*common.Account
+	closed bool
+}
+
+func newQueue() *queue {
+	q := &queue{}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+func (q *queue) push(a *common.Account) {
+	q.mu.Lock()
+	q.items = append(q.items, a)
+	q.mu.Unlock()
+	q.cond.Signal()
+}
+
+func (q *queue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	q.cond.Broadcast()
+}
+
+// pop blocks until an account is available and returns it, or returns false
+// once the queue is closed and empty.
+func (q *queue) pop() (*common.Account, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for len(q.items) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+
+	if len(q.items) == 0 {
+		return nil, false
+	}
+
+	a := q.items[0]
+	q.items[0] = nil
+	q.items = q.items[1:]
+
+	return a, true
+}
@@ -0,0 +1,134 @@
+package fetch
+
+import (
+	"context"
+	"flag"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/logston/aws-aliased-profiles/common"
+	"github.com/logston/aws-aliased-profiles/fetch/fetchtest"
+)
+
+// The number of accounts in the organization fetched by the benchmarks, e.g.
+// go test -run '^$' -bench . ./fetch -accounts 500 for a quicker run.
+var benchmarkAccounts = flag.Int("accounts", 5000, "number of accounts in the organization fetched by the benchmarks")
+
+// The shape of the organization fetched by the benchmarks, and how many
+// accounts have their tags and aliases fetched at the same time. Every
+// request to the fetchtest server takes benchmarkLatency.
+const (
+	benchmarkOUs              = 5
+	benchmarkLatency          = 2 * time.Millisecond
+	benchmarkTagsConcurrency  = 4
+	benchmarkAliasConcurrency = 10
+)
+
+// benchmarkOptions starts a fetchtest server for the benchmark and returns
+// the options to fetch from it.
+func benchmarkOptions(b *testing.B) Options {
+	useHome(b)
+
+	s := fetchtest.NewServer()
+	b.Cleanup(s.Close)
+
+	s.SetLatency(benchmarkLatency)
+	s.Generate(*benchmarkAccounts, benchmarkOUs)
+
+	opts := serverOptions(b, s)
+	opts.Concurrency = benchmarkAliasConcurrency
+
+	return opts
+}
+
+// BenchmarkPipeline fetches the organization with the pipeline fetch uses,
+// which fetches the tags and alias of each account as soon as it is listed.
+func BenchmarkPipeline(b *testing.B) {
+	opts := benchmarkOptions(b)
+	ctx := context.Background()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		src := NewAWSSource(opts)
+		b.StartTimer()
+
+		p := &Pipeline{
+			Source:           src,
+			TagsConcurrency:  benchmarkTagsConcurrency,
+			AliasConcurrency: benchmarkAliasConcurrency,
+		}
+		if _, err := p.Run(ctx); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkPhased fetches the organization the way fetch did before the
+// pipeline: each stage starts once the previous one has finished for every
+// account.
+func BenchmarkPhased(b *testing.B) {
+	opts := benchmarkOptions(b)
+	ctx := context.Background()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		src := NewAWSSource(opts)
+		b.StartTimer()
+
+		if err := runPhased(ctx, src, benchmarkTagsConcurrency, benchmarkAliasConcurrency); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// runPhased lists every account of src, then fetches the tags of every
+// account, and then the alias of every account.
+func runPhased(ctx context.Context, src AccountSource, tagsConcurrency, aliasConcurrency int) error {
+	var al []*common.Account
+	err := src.ListAccounts(ctx, func(page []*common.Account) error {
+		al = append(al, page...)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if err = forEach(ctx, al, tagsConcurrency, src.Tags); err != nil {
+		return err
+	}
+
+	return forEach(ctx, al, aliasConcurrency, src.Alias)
+}
+
+// forEach calls fn with each account, from concurrency goroutines.
+func forEach(ctx context.Context, al []*common.Account, concurrency int, fn func(context.Context, *common.Account) error) error {
+	eg, ctx := errgroup.WithContext(ctx)
+
+	var mu sync.Mutex
+	next := 0
+	for i := 0; i < concurrency; i++ {
+		eg.Go(func() error {
+			for {
+				mu.Lock()
+				if next == len(al) {
+					mu.Unlock()
+					return nil
+				}
+				a := al[next]
+				next++
+				mu.Unlock()
+
+				if err := fn(ctx, a); err != nil {
+					return err
+				}
+			}
+		})
+	}
+
+	return eg.Wait()
+}
@@ -0,0 +1,291 @@
+package fetch
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+const (
+	// MaxAttempts is the number of times a call is made before its throttling
+	// or transient error is returned.
+	MaxAttempts = 8
+
+	// The number of consecutive successful calls after which a limiter that
+	// backed off grows its rate and concurrency again.
+	recoverAfter = 20
+)
+
+// The range of the backoff between attempts, variables so that tests need
+// not wait out the retries of a call that is throttled every time.
+var (
+	baseBackoff = 200 * time.Millisecond
+	maxBackoff  = 20 * time.Second
+)
+
+// Default requests per second for each API. Organizations allows far fewer
+// requests per second than STS and IAM.
+const (
+	DefaultOrganizationsRPS = 5
+	DefaultSTSRPS           = 20
+	DefaultIAMRPS           = 20
+)
+
+// Limiter paces the calls made to a single AWS API. It combines a token
+// bucket, which bounds the request rate, with a semaphore, which bounds the
+// number of calls in flight. Both shrink when AWS reports throttling and grow
+// back as calls succeed.
+type Limiter struct {
+	Name string
+
+	mu sync.Mutex
+
+	maxRate float64
+	rate    float64
+	tokens  float64
+	last    time.Time
+
+	maxConcurrency int
+	concurrency    int
+	inFlight       int
+	released       chan struct{}
+
+	successes int
+
+	calls     int64
+	throttles int64
+	retries   int64
+}
+
+func NewLimiter(name string, rps float64, concurrency int) *Limiter {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	return &Limiter{
+		Name:           name,
+		maxRate:        rps,
+		rate:           rps,
+		tokens:         1,
+		last:           time.Now(),
+		maxConcurrency: concurrency,
+		concurrency:    concurrency,
+		released:       make(chan struct{}),
+	}
+}
+
+// Do calls fn once a slot and a token are available, retrying throttling and
+// transient errors with jittered exponential backoff.
+func (l *Limiter) Do(ctx context.Context, fn func() error) (err error) {
+	for attempt := 1; ; attempt++ {
+		if err = l.acquire(ctx); err != nil {
+			return
+		}
+		if err = l.wait(ctx); err != nil {
+			l.release()
+			return
+		}
+
+		atomic.AddInt64(&l.calls, 1)
+		err = fn()
+		l.release()
+
+		switch {
+		case err == nil:
+			l.succeeded()
+			return
+		case request.IsErrorThrottle(err):
+			atomic.AddInt64(&l.throttles, 1)
+			l.throttled()
+		case !isTransient(err):
+			return
+		}
+
+		if attempt == MaxAttempts {
+			return
+		}
+
+		atomic.AddInt64(&l.retries, 1)
+		if err = sleep(ctx, backoff(attempt)); err != nil {
+			return
+		}
+	}
+}
+
+// Stats returns a one line summary of the calls made through the limiter.
+func (l *Limiter) Stats() string {
+	return fmt.Sprintf("%s: %d calls, %d throttled, %d retried",
+		l.Name,
+		atomic.LoadInt64(&l.calls),
+		atomic.LoadInt64(&l.throttles),
+		atomic.LoadInt64(&l.retries),
+	)
+}
+
+// acquire blocks until fewer than the current concurrency limit of calls are
+// in flight.
+func (l *Limiter) acquire(ctx context.Context) error {
+	for {
+		l.mu.Lock()
+		if l.inFlight < l.concurrency {
+			l.inFlight++
+			l.mu.Unlock()
+			return nil
+		}
+		released := l.released
+		l.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-released:
+		}
+	}
+}
+
+func (l *Limiter) release() {
+	l.mu.Lock()
+	l.inFlight--
+	close(l.released)
+	l.released = make(chan struct{})
+	l.mu.Unlock()
+}
+
+// wait blocks until the token bucket allows another call. Tokens are
+// reserved up front so that concurrent waiters are spaced out evenly.
+func (l *Limiter) wait(ctx context.Context) error {
+	if l.maxRate <= 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	burst := l.rate
+	if burst < 1 {
+		burst = 1
+	}
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > burst {
+		l.tokens = burst
+	}
+	l.last = now
+	l.tokens--
+	var d time.Duration
+	if l.tokens < 0 {
+		d = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	return sleep(ctx, d)
+}
+
+// throttled halves the rate and concurrency of the limiter.
+func (l *Limiter) throttled() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.successes = 0
+	if l.rate/2 >= l.maxRate/16 {
+		l.rate /= 2
+	}
+	if l.concurrency > 1 {
+		l.concurrency /= 2
+	}
+}
+
+// succeeded grows the rate and concurrency of a limiter that previously
+// backed off, once enough calls in a row have succeeded.
+func (l *Limiter) succeeded() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.successes++
+	if l.successes < recoverAfter {
+		return
+	}
+	l.successes = 0
+
+	l.rate += l.maxRate / 10
+	if l.rate > l.maxRate {
+		l.rate = l.maxRate
+	}
+	if l.concurrency < l.maxConcurrency {
+		l.concurrency++
+		close(l.released)
+		l.released = make(chan struct{})
+	}
+}
+
+// Limiters holds a limiter for each AWS API called during a fetch.
+type Limiters struct {
+	Organizations *Limiter
+	STS           *Limiter
+	IAM           *Limiter
+}
+
+// NewLimiters returns limiters allowing at most concurrency calls in flight
+// per API. When rps is positive, it replaces the default requests per second
+// of every API.
+func NewLimiters(concurrency int, rps float64) *Limiters {
+	orgRPS, stsRPS, iamRPS := float64(DefaultOrganizationsRPS), float64(DefaultSTSRPS), float64(DefaultIAMRPS)
+	if rps > 0 {
+		orgRPS, stsRPS, iamRPS = rps, rps, rps
+	}
+
+	return &Limiters{
+		Organizations: NewLimiter("organizations", orgRPS, concurrency),
+		STS:           NewLimiter("sts", stsRPS, concurrency),
+		IAM:           NewLimiter("iam", iamRPS, concurrency),
+	}
+}
+
+func (ls *Limiters) PrintStats() {
+	for _, l := range []*Limiter{ls.Organizations, ls.STS, ls.IAM} {
+		fmt.Println(l.Stats())
+	}
+}
+
+func isTransient(err error) bool {
+	if request.IsErrorRetryable(err) {
+		return true
+	}
+
+	if rf, ok := err.(awserr.RequestFailure); ok {
+		return rf.StatusCode() >= 500
+	}
+
+	return false
+}
+
+// backoff returns a random duration of up to baseBackoff doubled for each
+// previous attempt, capped at maxBackoff ("full jitter").
+func backoff(attempt int) time.Duration {
+	d := baseBackoff << uint(attempt-1)
+	if d > maxBackoff || d <= 0 {
+		d = maxBackoff
+	}
+
+	return time.Duration(rand.Int63n(int64(d)))
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
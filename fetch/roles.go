@@ -0,0 +1,178 @@
+package fetch
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/service/iam"
+
+	"github.com/logston/aws-aliased-profiles/common"
+)
+
+// GetRoles records in a.Roles the roles of the account that the session may
+// assume. The candidate roles of discovery are probed with AssumeRole, as are
+// the roles listed with the assumed credentials of the fetch role when
+// discovery.List is set. assumed may be nil when no fetch role could be
+// assumed, in which case roles cannot be listed.
+func GetRoles(ctx context.Context, sess client.ConfigProvider, lim *Limiters, a *common.Account, assumed *credentials.Credentials, discovery common.RoleDiscoverySettings, assumeRole common.AssumeRoleSettings) (err error) {
+	candidates := append([]string(nil), discovery.Candidates...)
+
+	if discovery.List {
+		if assumed == nil {
+			return recordFailure(ctx, &a.FetchOutcome.Roles, fmt.Errorf("No fetch role could be assumed to list roles"), common.FetchAssumeRoleDenied)
+		}
+
+		var listed []string
+		if listed, err = listRoles(ctx, sess, lim, assumed, discovery); err != nil {
+			return recordFailure(ctx, &a.FetchOutcome.Roles, err, common.FetchListRolesDenied)
+		}
+		candidates = append(candidates, listed...)
+	}
+
+	assumeRoleOptions, err := AssumeRoleOptions(assumeRole, a.Id)
+	if err != nil {
+		return
+	}
+
+	var roles []string
+	seen := make(map[string]bool)
+	for _, role := range candidates {
+		role = trimRolePath(role)
+		if seen[role] {
+			continue
+		}
+		seen[role] = true
+
+		// The fetch role was already assumed while reading the alias.
+		if role == trimRolePath(a.AssumableRole) && assumed != nil {
+			roles = append(roles, role)
+			continue
+		}
+
+		creds := stscreds.NewCredentials(sess, a.RoleArn(role), assumeRoleOptions)
+		err = lim.STS.Do(ctx, func() (e error) {
+			_, e = creds.GetWithContext(ctx)
+			return
+		})
+		if err != nil {
+			if isAccessDenied(err) {
+				continue
+			}
+			return recordFailure(ctx, &a.FetchOutcome.Roles, err, common.FetchAssumeRoleDenied)
+		}
+
+		roles = append(roles, role)
+	}
+
+	a.Roles = roles
+	a.FetchedAt.Roles = time.Now()
+	a.FetchOutcome.Roles = common.FetchOutcome{Status: common.FetchOK}
+
+	return nil
+}
+
+// listRoles lists the roles of an account, using credentials assumed in it,
+// that match the filters of discovery.
+func listRoles(ctx context.Context, sess client.ConfigProvider, lim *Limiters, assumed *credentials.Credentials, discovery common.RoleDiscoverySettings) (roles []string, err error) {
+	svc := iam.New(sess, &aws.Config{Credentials: assumed})
+
+	input := &iam.ListRolesInput{}
+	if discovery.PathPrefix != "" {
+		input.PathPrefix = aws.String(discovery.PathPrefix)
+	}
+
+	var o *iam.ListRolesOutput
+	for {
+		if err = common.CheckContext(ctx); err != nil {
+			return
+		}
+
+		err = lim.IAM.Do(ctx, func() (e error) {
+			o, e = svc.ListRolesWithContext(ctx, input)
+			return
+		})
+		if err != nil {
+			return
+		}
+
+		for _, r := range o.Roles {
+			name := aws.StringValue(r.RoleName)
+			if !strings.HasPrefix(name, discovery.NamePrefix) {
+				continue
+			}
+
+			if len(discovery.Tags) != 0 {
+				var ok bool
+				if ok, err = roleHasTags(ctx, svc, lim, name, discovery.Tags); err != nil {
+					return
+				}
+				if !ok {
+					continue
+				}
+			}
+
+			roles = append(roles, aws.StringValue(r.Path)+name)
+		}
+
+		if !aws.BoolValue(o.IsTruncated) {
+			break
+		}
+
+		input.Marker = o.Marker
+	}
+
+	return
+}
+
+// roleHasTags reports whether the role carries every one of tags, each given
+// as "key" or "key=value".
+func roleHasTags(ctx context.Context, svc *iam.IAM, lim *Limiters, role string, tags []string) (ok bool, err error) {
+	have := make(map[string]string)
+
+	input := &iam.ListRoleTagsInput{RoleName: aws.String(role)}
+	var o *iam.ListRoleTagsOutput
+	for {
+		err = lim.IAM.Do(ctx, func() (e error) {
+			o, e = svc.ListRoleTagsWithContext(ctx, input)
+			return
+		})
+		if err != nil {
+			return
+		}
+
+		for _, t := range o.Tags {
+			have[aws.StringValue(t.Key)] = aws.StringValue(t.Value)
+		}
+
+		if !aws.BoolValue(o.IsTruncated) {
+			break
+		}
+
+		input.Marker = o.Marker
+	}
+
+	for _, tag := range tags {
+		kv := strings.SplitN(tag, "=", 2)
+		v, found := have[kv[0]]
+		if !found || (len(kv) == 2 && v != kv[1]) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// trimRolePath strips the leading slash, and "role/", from a role name
+// preceded by a path, e.g. "/team/ReadOnly" becomes "team/ReadOnly".
+func trimRolePath(role string) string {
+	role = strings.TrimPrefix(role, "/")
+	role = strings.TrimPrefix(role, "role/")
+
+	return strings.TrimPrefix(role, "/")
+}
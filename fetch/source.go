@@ -0,0 +1,114 @@
+package fetch
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+
+	"github.com/logston/aws-aliased-profiles/common"
+)
+
+// AccountSource is where the accounts of an organization are fetched from.
+//
+// Tags and Alias record failures to fetch the tags or alias of an account in
+// its FetchOutcome and only return an error to stop the whole fetch, e.g.
+// when the context is cancelled.
+type AccountSource interface {
+	// Organization describes the organization the accounts belong to.
+	Organization(ctx context.Context) (*common.Organization, error)
+
+	// ListAccounts passes the accounts of the organization to emit a page at
+	// a time, with their organizational units but without tags or aliases.
+	ListAccounts(ctx context.Context, emit func([]*common.Account) error) error
+
+	// Tags fetches the tags of the account.
+	Tags(ctx context.Context, a *common.Account) error
+
+	// Alias fetches the alias of the account.
+	Alias(ctx context.Context, a *common.Account) error
+}
+
+// AWSSource fetches accounts from AWS Organizations, assuming a role in each
+// account to read its alias.
+type AWSSource struct {
+	Session  *session.Session
+	Limiters *Limiters
+
+	// The roots or organizational units to list accounts from and to skip.
+	OUs        []string
+	ExcludeOUs []string
+
+	// The role names to try assuming, in order, to read each alias, and how
+	// to assume them.
+	AccountRoles []string
+	AssumeRole   common.AssumeRoleSettings
+
+	// How the roles that may be assumed in each account are discovered,
+	// after reading its alias.
+	RoleDiscovery common.RoleDiscoverySettings
+}
+
+// NewAWSSource returns a source for the organization of opts.MasterProfile.
+func NewAWSSource(opts Options) *AWSSource {
+	tokenProvider := stscreds.StdinTokenProvider
+	if opts.AssumeRole.MFACommand != "" {
+		tokenProvider = CommandTokenProvider(opts.AssumeRole.MFACommand)
+	}
+
+	// Retries are made by the limiters instead, which also back off.
+	config := aws.Config{MaxRetries: aws.Int(0)}
+	if opts.EndpointURL != "" {
+		// Clients made from the session, including the STS client used to
+		// assume roles, inherit the endpoint.
+		config.Endpoint = aws.String(opts.EndpointURL)
+	}
+
+	sess := session.Must(session.NewSessionWithOptions(session.Options{
+		SharedConfigState:       session.SharedConfigEnable,
+		AssumeRoleTokenProvider: tokenProvider,
+		Profile:                 opts.MasterProfile,
+		Config:                  config,
+	}))
+
+	return &AWSSource{
+		Session:      sess,
+		Limiters:     NewLimiters(opts.Concurrency, opts.RPS),
+		OUs:          opts.OUs,
+		ExcludeOUs:   opts.ExcludeOUs,
+		AccountRoles: opts.AccountRoles,
+		AssumeRole:   opts.AssumeRole,
+
+		RoleDiscovery: opts.RoleDiscovery,
+	}
+}
+
+func (s *AWSSource) Organization(ctx context.Context) (*common.Organization, error) {
+	org, err := GetOrganization(ctx, s.Session, s.Limiters)
+	if err != nil {
+		return nil, err
+	}
+	org.Partition = GetPartition(s.Session)
+
+	return org, nil
+}
+
+func (s *AWSSource) ListAccounts(ctx context.Context, emit func([]*common.Account) error) error {
+	return WalkAccounts(ctx, s.Session, s.Limiters, s.OUs, s.ExcludeOUs, emit)
+}
+
+func (s *AWSSource) Tags(ctx context.Context, a *common.Account) error {
+	return GetTagsForAccount(ctx, s.Session, s.Limiters, a)
+}
+
+// Alias fetches the alias of the account and, when role discovery is
+// enabled, the roles that may be assumed in it.
+func (s *AWSSource) Alias(ctx context.Context, a *common.Account) error {
+	assumed, err := getAlias(ctx, s.Session, s.Limiters, a, s.AccountRoles, s.AssumeRole)
+	if err != nil || !s.RoleDiscovery.Enabled() {
+		return err
+	}
+
+	return GetRoles(ctx, s.Session, s.Limiters, a, assumed, s.RoleDiscovery, s.AssumeRole)
+}
@@ -0,0 +1,315 @@
+package fetch
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sso"
+
+	"github.com/logston/aws-aliased-profiles/common"
+)
+
+// DefaultSSORPS is the default requests per second to the IAM Identity
+// Center portal.
+const DefaultSSORPS = 10
+
+// SSOSource fetches the accounts, and the roles assigned in each, that the
+// signed in user may access through an IAM Identity Center (AWS SSO) portal.
+// It needs no access to AWS Organizations, but accounts have no aliases,
+// tags or organizational units.
+type SSOSource struct {
+	Client  *sso.SSO
+	Limiter *Limiter
+
+	// The portal, with StartURL and Region resolved, and the access token
+	// cached by aws sso login for it.
+	Settings    common.SSOSettings
+	AccessToken string
+}
+
+// SSO fetches the accounts of the portal in opts.SSO into the state file of
+// opts.Org and returns the number of accounts whose roles could not be
+// fetched.
+func SSO(ctx context.Context, opts Options) (failed int) {
+	if opts.Concurrency < 1 {
+		opts.Concurrency = 1
+	}
+
+	src, err := NewSSOSource(opts)
+	common.ExitWithError(err)
+	defer func() { fmt.Println(src.Limiter.Stats()) }()
+
+	return Fetch(ctx, src, opts)
+}
+
+// NewSSOSource returns a source for the portal in opts.SSO using the access
+// token cached by aws sso login.
+func NewSSOSource(opts Options) (src *SSOSource, err error) {
+	settings, err := ResolveSSOSettings(opts.SSO)
+	if err != nil {
+		return
+	}
+
+	token, err := ReadSSOToken(settings)
+	if err != nil {
+		return
+	}
+
+	// Retries are made by the limiter instead, which also backs off.
+	config := &aws.Config{
+		Region:     aws.String(settings.Region),
+		MaxRetries: aws.Int(0),
+	}
+	if opts.EndpointURL != "" {
+		config.Endpoint = aws.String(opts.EndpointURL)
+	}
+
+	sess, err := session.NewSession(config)
+	if err != nil {
+		return
+	}
+
+	rps := float64(DefaultSSORPS)
+	if opts.RPS > 0 {
+		rps = opts.RPS
+	}
+
+	return &SSOSource{
+		Client:      sso.New(sess),
+		Limiter:     NewLimiter("sso", rps, opts.Concurrency),
+		Settings:    settings,
+		AccessToken: token,
+	}, nil
+}
+
+func (s *SSOSource) Organization(ctx context.Context) (*common.Organization, error) {
+	partition := common.DefaultPartition
+	if p := GetPartitionForRegion(s.Settings.Region); p != "" {
+		partition = p
+	}
+
+	return &common.Organization{
+		Partition:   partition,
+		SSOSession:  s.Settings.Session,
+		SSOStartURL: s.Settings.StartURL,
+		SSORegion:   s.Settings.Region,
+	}, nil
+}
+
+func (s *SSOSource) ListAccounts(ctx context.Context, emit func([]*common.Account) error) (err error) {
+	var o *sso.ListAccountsOutput
+	var nextToken *string
+	for {
+		if err = common.CheckContext(ctx); err != nil {
+			return
+		}
+
+		err = s.Limiter.Do(ctx, func() (e error) {
+			o, e = s.Client.ListAccountsWithContext(ctx, &sso.ListAccountsInput{
+				AccessToken: &s.AccessToken,
+				MaxResults:  MaxResults,
+				NextToken:   nextToken,
+			})
+			return
+		})
+		if err != nil {
+			return
+		}
+
+		var al []*common.Account
+		for _, sa := range o.AccountList {
+			al = append(al, &common.Account{
+				Id:    aws.StringValue(sa.AccountId),
+				Name:  aws.StringValue(sa.AccountName),
+				Email: aws.StringValue(sa.EmailAddress),
+			})
+		}
+		if err = emit(al); err != nil {
+			return
+		}
+
+		if o.NextToken == nil {
+			break
+		}
+
+		nextToken = o.NextToken
+	}
+
+	return
+}
+
+// Tags does nothing, as the portal does not expose the tags of accounts.
+func (s *SSOSource) Tags(ctx context.Context, a *common.Account) error {
+	return nil
+}
+
+// Alias fetches the roles assigned to the user in the account, as the portal
+// does not expose aliases. The empty alias is recorded as fetched along with
+// the roles, so that incremental and resumed fetches, which go by when the
+// alias was fetched, reuse the roles.
+func (s *SSOSource) Alias(ctx context.Context, a *common.Account) (err error) {
+	var roles []string
+	var o *sso.ListAccountRolesOutput
+	var nextToken *string
+	for {
+		if err = common.CheckContext(ctx); err != nil {
+			return
+		}
+
+		err = s.Limiter.Do(ctx, func() (e error) {
+			o, e = s.Client.ListAccountRolesWithContext(ctx, &sso.ListAccountRolesInput{
+				AccessToken: &s.AccessToken,
+				AccountId:   &a.Id,
+				MaxResults:  MaxResults,
+				NextToken:   nextToken,
+			})
+			return
+		})
+		if err != nil {
+			return recordFailure(ctx, &a.FetchOutcome.Roles, err, common.FetchListRolesDenied)
+		}
+
+		for _, r := range o.RoleList {
+			roles = append(roles, aws.StringValue(r.RoleName))
+		}
+
+		if o.NextToken == nil {
+			break
+		}
+
+		nextToken = o.NextToken
+	}
+
+	a.Alias = ""
+	a.Roles = roles
+	a.FetchedAt.Roles = time.Now()
+	a.FetchedAt.Alias = a.FetchedAt.Roles
+	a.FetchOutcome.Roles = common.FetchOutcome{Status: common.FetchOK}
+
+	return
+}
+
+// ResolveSSOSettings fills in the start URL and region of s from its
+// [sso-session] section in ~/.aws/config.
+func ResolveSSOSettings(s common.SSOSettings) (common.SSOSettings, error) {
+	if s.Session != "" && (s.StartURL == "" || s.Region == "") {
+		values, err := readConfigSection(common.GetAWSPath(common.AWSConfigFilename), "sso-session "+s.Session)
+		if err != nil {
+			return s, err
+		}
+		if values == nil {
+			return s, fmt.Errorf("No [sso-session %s] section in %s", s.Session, common.GetAWSPath(common.AWSConfigFilename))
+		}
+
+		if s.StartURL == "" {
+			s.StartURL = values["sso_start_url"]
+		}
+		if s.Region == "" {
+			s.Region = values["sso_region"]
+		}
+	}
+
+	if s.StartURL == "" || s.Region == "" {
+		return s, fmt.Errorf("The SSO start URL and region are required")
+	}
+
+	return s, nil
+}
+
+// ssoToken is a token cached by aws sso login.
+type ssoToken struct {
+	AccessToken string `json:"accessToken"`
+	ExpiresAt   string `json:"expiresAt"`
+}
+
+// ReadSSOToken returns the access token cached by aws sso login for the
+// portal. Tokens are cached in ~/.aws/sso/cache under the SHA-1 of the
+// session name or, without a session, of the start URL.
+func ReadSSOToken(s common.SSOSettings) (token string, err error) {
+	key := s.StartURL
+	if s.Session != "" {
+		key = s.Session
+	}
+	sum := sha1.Sum([]byte(key))
+	path := common.GetAWSPath("sso", "cache", hex.EncodeToString(sum[:])+".json")
+
+	login := "aws sso login"
+	if s.Session != "" {
+		login += " --sso-session " + s.Session
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", fmt.Errorf("No cached SSO token for %s, run %s", key, login)
+	}
+	if err != nil {
+		return
+	}
+
+	var t ssoToken
+	if err = json.Unmarshal(data, &t); err != nil {
+		return "", fmt.Errorf("Failed to read %s: %s", path, err)
+	}
+
+	// Older versions of the AWS CLI wrote e.g. "2021-01-01T00:00:00UTC".
+	expiresAt, err := time.Parse(time.RFC3339, t.ExpiresAt)
+	if err != nil {
+		expiresAt, err = time.Parse("2006-01-02T15:04:05UTC", t.ExpiresAt)
+	}
+	if err != nil {
+		return "", fmt.Errorf("Failed to read the expiry of %s: %s", path, err)
+	}
+
+	if !time.Now().Before(expiresAt) {
+		return "", fmt.Errorf("The cached SSO token for %s expired at %s, run %s", key, expiresAt.Local().Format(time.RFC1123), login)
+	}
+
+	return t.AccessToken, nil
+}
+
+// readConfigSection returns the keys and values of the section with the given
+// name, e.g. "sso-session acme", in an AWS config file, or nil if there is no
+// such section.
+func readConfigSection(path, name string) (values map[string]string, err error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	in := false
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			in = strings.Join(strings.Fields(line[1:len(line)-1]), " ") == name
+			if in && values == nil {
+				values = make(map[string]string)
+			}
+			continue
+		}
+
+		if kv := strings.SplitN(line, "=", 2); in && len(kv) == 2 {
+			values[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+	}
+
+	return values, scanner.Err()
+}
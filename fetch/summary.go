@@ -0,0 +1,121 @@
+package fetch
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/logston/aws-aliased-profiles/common"
+)
+
+// PrintFetchSummary prints how many aliases and tags, and roles if any were
+// discovered, were fetched with each outcome, followed by every failure, and
+// returns the number of accounts with at least one failure. An account
+// beneath a root or organizational unit whose tags could not be fetched
+// counts as failed, since it is missing the tags it would inherit.
+func PrintFetchSummary(al []*common.Account) (failed int) {
+	aliases := make(map[string]int)
+	tags := make(map[string]int)
+	roles := make(map[string]int)
+	seen := make(map[string]bool)
+	for _, a := range al {
+		aliases[a.FetchOutcome.Alias.Status]++
+		tags[a.FetchOutcome.Tags.Status]++
+		seen[a.FetchOutcome.Alias.Status] = true
+		seen[a.FetchOutcome.Tags.Status] = true
+		if a.FetchOutcome.Roles.Status != "" {
+			roles[a.FetchOutcome.Roles.Status]++
+			seen[a.FetchOutcome.Roles.Status] = true
+		}
+	}
+
+	var statuses []string
+	for status := range seen {
+		if status != "" {
+			statuses = append(statuses, status)
+		}
+	}
+	sort.Strings(statuses)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	if len(roles) == 0 {
+		fmt.Fprintln(w, "OUTCOME\tALIASES\tTAGS")
+		for _, status := range statuses {
+			fmt.Fprintf(w, "%s\t%d\t%d\n", status, aliases[status], tags[status])
+		}
+	} else {
+		fmt.Fprintln(w, "OUTCOME\tALIASES\tTAGS\tROLES")
+		for _, status := range statuses {
+			fmt.Fprintf(w, "%s\t%d\t%d\t%d\n", status, aliases[status], tags[status], roles[status])
+		}
+	}
+	w.Flush()
+
+	var failures [][]string
+	var failedOUs []*common.OrganizationalUnit
+	seenOUs := make(map[string]bool)
+	attrFailed := 0
+	for _, a := range al {
+		ouFailed := false
+		for _, ou := range a.OUs {
+			if !ou.FetchOutcome.Failed() {
+				continue
+			}
+			ouFailed = true
+			if !seenOUs[ou.Id] {
+				seenOUs[ou.Id] = true
+				failedOUs = append(failedOUs, ou)
+			}
+		}
+
+		if a.FetchOutcome.Alias.Failed() || a.FetchOutcome.Tags.Failed() || a.FetchOutcome.Roles.Failed() {
+			attrFailed++
+			failed++
+		} else if ouFailed {
+			failed++
+		}
+		for _, f := range []struct {
+			attr string
+			o    common.FetchOutcome
+		}{{"alias", a.FetchOutcome.Alias}, {"tags", a.FetchOutcome.Tags}, {"roles", a.FetchOutcome.Roles}} {
+			if f.o.Failed() {
+				failures = append(failures, []string{a.Id, f.attr, f.o.Status, f.o.Error})
+			}
+		}
+	}
+
+	if len(failures) != 0 {
+		fmt.Printf("\nFailed to fetch %d accounts:\n", attrFailed)
+		w = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ACCOUNT\tATTRIBUTE\tOUTCOME\tERROR")
+		for _, f := range failures {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", f[0], f[1], f[2], firstLine(f[3]))
+		}
+		w.Flush()
+	}
+
+	if len(failedOUs) != 0 {
+		sort.Slice(failedOUs, func(i, j int) bool { return failedOUs[i].Id < failedOUs[j].Id })
+
+		fmt.Printf("\nFailed to fetch the tags of %d roots or organizational units, whose accounts do not inherit them:\n", len(failedOUs))
+		w = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "OU\tNAME\tOUTCOME\tERROR")
+		for _, ou := range failedOUs {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", ou.Id, ou.Name, ou.FetchOutcome.Status, firstLine(ou.FetchOutcome.Error))
+		}
+		w.Flush()
+	}
+
+	return
+}
+
+func firstLine(s string) string {
+	for i, r := range s {
+		if r == '\n' {
+			return s[:i]
+		}
+	}
+
+	return s
+}
@@ -4,6 +4,8 @@ go 1.14
 
 require (
 	github.com/aws/aws-sdk-go v1.35.23
+	github.com/jmespath/go-jmespath v0.4.0
 	github.com/spf13/cobra v1.1.1
 	golang.org/x/sync v0.0.0-20201020160332-67f06af15bc9
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,403 @@
+// Package inventory imports accounts that cannot be fetched, e.g. those of
+// partner organizations, from CSV, YAML or JSON files into the state.
+package inventory
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/logston/aws-aliased-profiles/common"
+)
+
+// The formats of inventory files.
+const (
+	CSV  = "csv"
+	YAML = "yaml"
+	JSON = "json"
+)
+
+// Statuses are the account statuses an inventory may give. Accounts without
+// a status are ACTIVE.
+var Statuses = []string{"ACTIVE", "SUSPENDED", "PENDING_CLOSURE"}
+
+// Entry is an account in an inventory file. In YAML and JSON files, Tags is
+// a map of tag keys to values.
+type Entry struct {
+	Id     string            `json:"id" yaml:"id"`
+	Alias  string            `json:"alias" yaml:"alias"`
+	Name   string            `json:"name" yaml:"name"`
+	Email  string            `json:"email" yaml:"email"`
+	Status string            `json:"status" yaml:"status"`
+	Tags   map[string]string `json:"tags" yaml:"tags"`
+
+	// Where the entry is in the file, e.g. "row 3", for errors.
+	at string
+}
+
+type Options struct {
+	// The name of the organization in the settings file whose state the
+	// accounts are written to, empty for state.json.
+	Org string
+
+	// The format of the file, guessed from its extension when empty.
+	Format string
+
+	// Merge the accounts into the existing state instead of replacing it.
+	Merge bool
+
+	// Replace the existing state even if it was fetched rather than
+	// imported.
+	Force bool
+}
+
+// Import reads the accounts in the inventory file at path and writes them
+// to the state of opts.Org. The accounts of an organization with Import set
+// in the settings are never fetched, so they are kept until imported again.
+// A fetched state is only replaced with Force, and accounts merged into one
+// are dropped by the next fetch.
+func Import(path string, opts Options) {
+	started := time.Now()
+
+	format := opts.Format
+	if format == "" {
+		format = FormatOf(path)
+	}
+
+	f, err := os.Open(path)
+	common.ExitWithError(err)
+	defer f.Close()
+
+	entries, err := Parse(f, format)
+	if err != nil {
+		common.ExitWithError(fmt.Errorf("Could not read %s: %v", path, err))
+	}
+
+	org := &common.Organization{Name: opts.Org, Partition: common.DefaultPartition}
+	found := opts.Org == ""
+	for _, o := range common.ReadSettings().Organizations {
+		if o.Name == opts.Org {
+			org.ProfilePrefix = o.ProfilePrefix
+			found = true
+			if !o.Import {
+				fmt.Printf("Warning: organization %s is fetched, which will replace the accounts imported into it; set \"Import\": true for it in settings\n", opts.Org)
+			}
+		}
+	}
+	if !found {
+		fmt.Printf("Warning: no organization named %s in settings, upsert will not read its state until {\"Name\": %q, \"Import\": true} is added to its Organizations\n", opts.Org, opts.Org)
+	}
+
+	imported := Accounts(entries, org)
+	if err := Validate(imported); err != nil {
+		common.ExitWithError(err)
+	}
+
+	meta := common.StateMetadata{StartedAt: started, ImportedFrom: path}
+
+	var al []*common.Account
+	var added, updated int
+	// The state is read even when replacing it, so that a remote backend
+	// only accepts the import if no other run replaced the state meanwhile.
+	state := common.ReadStateIfExists(opts.Org)
+	fetched := state != nil && !state.Metadata.Imported()
+	if fetched && !opts.Merge && !opts.Force {
+		common.ExitWithError(fmt.Errorf("%s was written by fetch, please import into an organization with \"Import\": true in settings instead, or pass --merge to add the accounts to it or --force to replace it", common.GetStatePath(opts.Org)))
+	}
+	if opts.Merge && state != nil {
+		al, added, updated = Merge(state.Accounts, imported)
+	} else {
+		al, added = imported, len(imported)
+	}
+
+	if opts.Merge && fetched {
+		// The state is still that of the fetch.
+		meta = state.Metadata
+		if added != 0 {
+			fmt.Printf("Warning: %s was written by fetch, which will drop the %d accounts added to it; import them into an organization with \"Import\": true in settings instead\n", common.GetStatePath(opts.Org), added)
+		}
+	}
+
+	// Aliases may also collide with those of accounts already in the state.
+	if err := Validate(al); err != nil {
+		common.ExitWithError(err)
+	}
+
+	for _, a := range al {
+		if a.Status == "" {
+			a.Status = "ACTIVE"
+		}
+	}
+
+	if meta.Imported() {
+		meta.FinishedAt = time.Now()
+	}
+	common.WriteAccountList(opts.Org, al, meta)
+
+	fmt.Printf("Imported %d accounts from %s into %s: %d added, %d updated\n", len(imported), path, common.GetStatePath(opts.Org), added, updated)
+}
+
+// FormatOf returns the format of the inventory file at path from its
+// extension, CSV when unknown.
+func FormatOf(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return YAML
+	case ".json":
+		return JSON
+	}
+
+	return CSV
+}
+
+// Parse reads the entries of an inventory in the given format and checks
+// each of them.
+func Parse(r io.Reader, format string) (entries []*Entry, err error) {
+	switch format {
+	case CSV:
+		entries, err = parseCSV(r)
+	case YAML:
+		var data []byte
+		if data, err = ioutil.ReadAll(r); err != nil {
+			return
+		}
+		err = yaml.UnmarshalStrict(data, &entries)
+	case JSON:
+		// Reject unknown fields, e.g. a misspelled alias, like YAML does.
+		dec := json.NewDecoder(r)
+		dec.DisallowUnknownFields()
+		if err = dec.Decode(&entries); err == nil {
+			if _, err = dec.Token(); err == io.EOF {
+				err = nil
+			} else if err == nil {
+				err = fmt.Errorf("Unexpected data after the list of accounts")
+			}
+		}
+	default:
+		return nil, fmt.Errorf("Unknown format %q, expected %s, %s or %s", format, CSV, YAML, JSON)
+	}
+	if err != nil {
+		return
+	}
+
+	var problems []string
+	for i, e := range entries {
+		if format != CSV {
+			if e == nil {
+				problems = append(problems, fmt.Sprintf("  entry %d: empty", i+1))
+				continue
+			}
+			e.at = fmt.Sprintf("entry %d", i+1)
+		}
+		if problem := e.check(); problem != "" {
+			problems = append(problems, fmt.Sprintf("  %s: %s", e.at, problem))
+		}
+	}
+	if len(problems) != 0 {
+		return nil, fmt.Errorf("Invalid accounts:\n%s", strings.Join(problems, "\n"))
+	}
+
+	return
+}
+
+// parseCSV reads a CSV inventory whose header names the columns. The id,
+// alias, name, email and status columns fill those fields, and every other
+// column, optionally prefixed with "tag:", is a tag. Empty tag values are
+// skipped.
+func parseCSV(r io.Reader) (entries []*Entry, err error) {
+	cr := csv.NewReader(r)
+	cr.TrimLeadingSpace = true
+
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return
+	}
+	for i, h := range header {
+		header[i] = strings.TrimSpace(h)
+	}
+
+	hasId := false
+	for _, h := range header {
+		hasId = hasId || strings.EqualFold(h, "id")
+	}
+	if !hasId {
+		return nil, fmt.Errorf("The header has no id column")
+	}
+
+	for {
+		var row []string
+		if row, err = cr.Read(); err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return
+		}
+
+		e := &Entry{at: fmt.Sprintf("row %d", len(entries)+1)}
+		for i, h := range header {
+			v := strings.TrimSpace(row[i])
+			switch strings.ToLower(h) {
+			case "id":
+				e.Id = v
+			case "alias":
+				e.Alias = v
+			case "name":
+				e.Name = v
+			case "email":
+				e.Email = v
+			case "status":
+				e.Status = v
+			default:
+				if v == "" {
+					continue
+				}
+				if e.Tags == nil {
+					e.Tags = make(map[string]string)
+				}
+				e.Tags[strings.TrimPrefix(h, "tag:")] = v
+			}
+		}
+
+		entries = append(entries, e)
+	}
+}
+
+// check returns what is wrong with the entry, if anything, and upper cases
+// its status.
+func (e *Entry) check() string {
+	if !common.IsAccountId(e.Id) {
+		return fmt.Sprintf("account ID %q is not 12 digits", e.Id)
+	}
+
+	e.Status = strings.ToUpper(e.Status)
+	if e.Status == "" {
+		return ""
+	}
+	for _, s := range Statuses {
+		if e.Status == s {
+			return ""
+		}
+	}
+
+	return fmt.Sprintf("status %q of %s is not one of %s", e.Status, e.Id, strings.Join(Statuses, ", "))
+}
+
+// Accounts returns the accounts of the entries in the organization, with
+// their tags sorted by key. Accounts without a status are left without one so
+// that merging them keeps the status in the state.
+func Accounts(entries []*Entry, org *common.Organization) (al []*common.Account) {
+	for _, e := range entries {
+		a := &common.Account{
+			Id:     e.Id,
+			Name:   e.Name,
+			Email:  e.Email,
+			Status: e.Status,
+			Alias:  e.Alias,
+			Org:    org,
+		}
+		for k, v := range e.Tags {
+			a.Tags = append(a.Tags, &common.Tag{Key: k, Value: v})
+		}
+		sort.Slice(a.Tags, func(i, j int) bool { return a.Tags[i].Key < a.Tags[j].Key })
+
+		al = append(al, a)
+	}
+
+	return
+}
+
+// Merge returns the accounts in state with those imported added, or merged
+// into the account with the same ID. A merged account takes the alias, name,
+// email and status of the imported one, where given, and its tags override
+// those of the same key. The imported accounts must have distinct IDs.
+func Merge(state, imported []*common.Account) (al []*common.Account, added, updated int) {
+	byId := make(map[string]*common.Account, len(state))
+	for _, a := range state {
+		byId[a.Id] = a
+		al = append(al, a)
+	}
+
+	for _, ia := range imported {
+		a, ok := byId[ia.Id]
+		if !ok {
+			byId[ia.Id] = ia
+			al = append(al, ia)
+			added++
+			continue
+		}
+
+		if ia.Alias != "" {
+			a.Alias = ia.Alias
+		}
+		if ia.Name != "" {
+			a.Name = ia.Name
+		}
+		if ia.Email != "" {
+			a.Email = ia.Email
+		}
+		if ia.Status != "" {
+			a.Status = ia.Status
+		}
+
+		for _, it := range ia.Tags {
+			replaced := false
+			for _, t := range a.Tags {
+				if t.Key == it.Key {
+					t.Value, replaced = it.Value, true
+				}
+			}
+			if !replaced {
+				a.Tags = append(a.Tags, it)
+			}
+		}
+
+		updated++
+	}
+
+	return
+}
+
+// Validate returns an error naming every account ID listed more than once
+// and every alias shared by more than one account.
+func Validate(al []*common.Account) error {
+	ids := make(map[string]int)
+	aliases := make(map[string][]string)
+	for _, a := range al {
+		ids[a.Id]++
+		if a.Alias != "" {
+			aliases[a.Alias] = append(aliases[a.Alias], a.Id)
+		}
+	}
+
+	var problems []string
+	for id, n := range ids {
+		if n > 1 {
+			problems = append(problems, fmt.Sprintf("  account %s is listed %d times", id, n))
+		}
+	}
+	for alias, accounts := range aliases {
+		if len(accounts) > 1 {
+			problems = append(problems, fmt.Sprintf("  alias %s is used by %s", alias, strings.Join(accounts, ", ")))
+		}
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+
+	sort.Strings(problems)
+
+	return fmt.Errorf("Invalid accounts:\n%s", strings.Join(problems, "\n"))
+}
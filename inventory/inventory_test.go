@@ -0,0 +1,283 @@
+package inventory
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/logston/aws-aliased-profiles/common"
+)
+
+// describe returns the fields and sorted tags of each entry on a line.
+func describe(entries []*Entry) (lines []string) {
+	for _, e := range entries {
+		var tags []string
+		for k, v := range e.Tags {
+			tags = append(tags, k+"="+v)
+		}
+		sort.Strings(tags)
+		lines = append(lines, fmt.Sprintf("%s alias=%s name=%s email=%s status=%s tags=%s", e.Id, e.Alias, e.Name, e.Email, e.Status, strings.Join(tags, ",")))
+	}
+
+	return
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		data   string
+		want   []string
+		err    string
+	}{
+		{
+			name:   "csv",
+			format: CSV,
+			data: "id,alias,name,email,status,environment,tag:team\n" +
+				"123456789012,partner-prod,Partner Prod,ops@example.com,active,production,data\n" +
+				"210987654321, partner-dev ,Partner Dev,,,,\n",
+			want: []string{
+				"123456789012 alias=partner-prod name=Partner Prod email=ops@example.com status=ACTIVE tags=environment=production,team=data",
+				"210987654321 alias=partner-dev name=Partner Dev email= status= tags=",
+			},
+		},
+		{
+			name:   "csv header in any case and order",
+			format: CSV,
+			data:   "Alias, ID ,Status\npartner,123456789012,Suspended\n",
+			want:   []string{"123456789012 alias=partner name= email= status=SUSPENDED tags="},
+		},
+		{
+			name:   "empty csv",
+			format: CSV,
+			data:   "",
+		},
+		{
+			name:   "csv without id column",
+			format: CSV,
+			data:   "alias,name\npartner,Partner\n",
+			err:    "no id column",
+		},
+		{
+			name:   "csv with a short row",
+			format: CSV,
+			data:   "id,alias\n123456789012\n",
+			err:    "wrong number of fields",
+		},
+		{
+			name:   "yaml",
+			format: YAML,
+			data:   "- id: \"123456789012\"\n  alias: partner-prod\n  status: pending_closure\n  tags:\n    environment: production\n",
+			want:   []string{"123456789012 alias=partner-prod name= email= status=PENDING_CLOSURE tags=environment=production"},
+		},
+		{
+			name:   "yaml with an unknown field",
+			format: YAML,
+			data:   "- id: \"123456789012\"\n  owner: someone\n",
+			err:    "field owner not found",
+		},
+		{
+			name:   "json",
+			format: JSON,
+			data:   `[{"id": "123456789012", "name": "Partner", "tags": {"team": "data"}}]`,
+			want:   []string{"123456789012 alias= name=Partner email= status= tags=team=data"},
+		},
+		{
+			name:   "json with an unknown field",
+			format: JSON,
+			data:   `[{"id": "123456789012", "alais": "partner-prod"}]`,
+			err:    `unknown field "alais"`,
+		},
+		{
+			name:   "json with data after the list",
+			format: JSON,
+			data:   `[{"id": "123456789012"}] [{"id": "210987654321"}]`,
+			err:    "Unexpected data after the list of accounts",
+		},
+		{
+			name:   "empty json entry",
+			format: JSON,
+			data:   `[{"id": "123456789012"}, null]`,
+			err:    "entry 2: empty",
+		},
+		{
+			name:   "empty yaml entry",
+			format: YAML,
+			data:   "- id: \"123456789012\"\n- \n- id: \"210987654321\"\n",
+			err:    "entry 2: empty",
+		},
+		{
+			name:   "ids that are not 12 digits",
+			format: CSV,
+			data:   "id\n12345678901\n1234567890123\nabcdefghijkl\n123456789012\n",
+			err:    `row 1: account ID "12345678901" is not 12 digits` + "\n" + `  row 2: account ID "1234567890123"`,
+		},
+		{
+			name:   "unknown status",
+			format: JSON,
+			data:   `[{"id": "123456789012", "status": "closed"}]`,
+			err:    `entry 1: status "CLOSED" of 123456789012 is not one of ACTIVE, SUSPENDED, PENDING_CLOSURE`,
+		},
+		{
+			name:   "unknown format",
+			format: "xml",
+			err:    `Unknown format "xml"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, err := Parse(strings.NewReader(tt.data), tt.format)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("Parse returned %v, want an error containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := describe(entries); strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("Parse returned\n  %s\nwant\n  %s", strings.Join(got, "\n  "), strings.Join(tt.want, "\n  "))
+			}
+		})
+	}
+}
+
+func TestFormatOf(t *testing.T) {
+	for path, want := range map[string]string{
+		"partners.csv":  CSV,
+		"partners.YAML": YAML,
+		"partners.yml":  YAML,
+		"partners.json": JSON,
+		"partners":      CSV,
+	} {
+		if got := FormatOf(path); got != want {
+			t.Errorf("FormatOf(%q) is %s, want %s", path, got, want)
+		}
+	}
+}
+
+// accounts returns an account for each "id" or "id=alias".
+func accounts(specs ...string) (al []*common.Account) {
+	for _, spec := range specs {
+		kv := strings.SplitN(spec, "=", 2)
+		a := &common.Account{Id: kv[0]}
+		if len(kv) == 2 {
+			a.Alias = kv[1]
+		}
+		al = append(al, a)
+	}
+
+	return
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		state    []*common.Account
+		imported []*common.Account
+		err      string
+	}{
+		{
+			name:     "distinct",
+			imported: accounts("111111111111=a", "222222222222=b", "333333333333"),
+		},
+		{
+			name:     "accounts without aliases",
+			imported: accounts("111111111111", "222222222222"),
+		},
+		{
+			name:     "repeated id",
+			imported: accounts("111111111111=a", "222222222222", "111111111111=c"),
+			err:      "account 111111111111 is listed 2 times",
+		},
+		{
+			name:     "repeated alias",
+			imported: accounts("111111111111=a", "222222222222=a"),
+			err:      "alias a is used by 111111111111, 222222222222",
+		},
+		{
+			name:     "alias of an account in the state",
+			state:    accounts("111111111111=a", "222222222222=b"),
+			imported: accounts("333333333333=b"),
+			err:      "alias b is used by 222222222222, 333333333333",
+		},
+		{
+			name:     "alias moved from an account in the state",
+			state:    accounts("111111111111=a", "222222222222=b"),
+			imported: accounts("111111111111=c", "333333333333=a"),
+		},
+		{
+			name:     "alias reimported for the same account",
+			state:    accounts("111111111111=a"),
+			imported: accounts("111111111111=a"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Import validates the accounts in the file, and then the state
+			// they are merged into.
+			err := Validate(tt.imported)
+			if err == nil {
+				al, _, _ := Merge(tt.state, tt.imported)
+				err = Validate(al)
+			}
+
+			if tt.err == "" {
+				if err != nil {
+					t.Errorf("Validate returned %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("Validate returned %v, want an error containing %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestMerge(t *testing.T) {
+	state := []*common.Account{
+		{Id: "111111111111", Alias: "a", Name: "A", Email: "a@example.com", Status: "ACTIVE", Tags: []*common.Tag{{Key: "env", Value: "dev"}, {Key: "team", Value: "x"}}},
+		{Id: "222222222222", Alias: "b", Status: "ACTIVE"},
+	}
+	imported := []*common.Account{
+		{Id: "111111111111", Name: "Renamed", Status: "SUSPENDED", Tags: []*common.Tag{{Key: "env", Value: "prod"}, {Key: "cost-center", Value: "42"}}},
+		{Id: "333333333333", Alias: "c"},
+	}
+
+	al, added, updated := Merge(state, imported)
+	if added != 1 || updated != 1 {
+		t.Errorf("Merge added %d and updated %d accounts, want 1 and 1", added, updated)
+	}
+
+	var ids []string
+	for _, a := range al {
+		ids = append(ids, a.Id)
+	}
+	if got := strings.Join(ids, ","); got != "111111111111,222222222222,333333333333" {
+		t.Fatalf("Merge returned accounts %s", got)
+	}
+
+	// Fields not given by the inventory are kept.
+	a := al[0]
+	if a.Alias != "a" || a.Name != "Renamed" || a.Email != "a@example.com" || a.Status != "SUSPENDED" {
+		t.Errorf("merged account is %+v", a)
+	}
+
+	var tags []string
+	for _, t := range a.Tags {
+		tags = append(tags, t.Key+"="+t.Value)
+	}
+	if got := strings.Join(tags, ","); got != "env=prod,team=x,cost-center=42" {
+		t.Errorf("merged tags are %s, want env=prod,team=x,cost-center=42", got)
+	}
+
+	if al[1] != state[1] || al[2] != imported[1] {
+		t.Error("Merge did not keep the untouched and added accounts")
+	}
+}
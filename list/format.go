@@ -0,0 +1,239 @@
+package list
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/logston/aws-aliased-profiles/common"
+)
+
+// Format writes accounts, or the result of a query, in a given format.
+type Format interface {
+	Write(w io.Writer, columns []*Column, al []*common.Account) error
+	WriteValue(w io.Writer, v interface{}) error
+}
+
+// Formats are the formats accounts can be listed in, by name.
+var Formats = map[string]Format{
+	"table":    tableFormat{},
+	"csv":      csvFormat{},
+	"json":     jsonFormat{},
+	"yaml":     yamlFormat{},
+	"markdown": markdownFormat{},
+}
+
+// FormatNames are the names of the Formats, in the order they are documented.
+var FormatNames = []string{"table", "csv", "json", "yaml", "markdown"}
+
+func getFormat(name string) (Format, error) {
+	if name == "" {
+		name = "table"
+	}
+
+	if f, ok := Formats[name]; ok {
+		return f, nil
+	}
+
+	return nil, fmt.Errorf("Unknown format %q, expected one of %s", name, strings.Join(FormatNames, ", "))
+}
+
+// The result of a query that is not a list of accounts is written as JSON by
+// every format other than YAML.
+type valueAsJSON struct{}
+
+func (valueAsJSON) WriteValue(w io.Writer, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintln(w, string(data))
+	return err
+}
+
+type tableFormat struct{ valueAsJSON }
+
+func (tableFormat) Write(w io.Writer, columns []*Column, al []*common.Account) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+
+	header := make([]string, 0, len(columns))
+	for _, c := range columns {
+		header = append(header, strings.ToUpper(c.Name))
+	}
+	fmt.Fprintln(tw, strings.Join(header, "\t"))
+
+	for _, a := range al {
+		fmt.Fprintln(tw, strings.Join(row(columns, a), "\t"))
+	}
+
+	return tw.Flush()
+}
+
+type csvFormat struct{ valueAsJSON }
+
+func (csvFormat) Write(w io.Writer, columns []*Column, al []*common.Account) error {
+	cw := csv.NewWriter(w)
+
+	header := make([]string, 0, len(columns))
+	for _, c := range columns {
+		header = append(header, c.Name)
+	}
+	cw.Write(header)
+
+	for _, a := range al {
+		cw.Write(row(columns, a))
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+type markdownFormat struct{ valueAsJSON }
+
+func (markdownFormat) Write(w io.Writer, columns []*Column, al []*common.Account) error {
+	header := make([]string, 0, len(columns))
+	rule := make([]string, 0, len(columns))
+	for _, c := range columns {
+		header = append(header, c.Name)
+		rule = append(rule, "---")
+	}
+	fmt.Fprintf(w, "| %s |\n", strings.Join(header, " | "))
+	fmt.Fprintf(w, "| %s |\n", strings.Join(rule, " | "))
+
+	for _, a := range al {
+		cells := row(columns, a)
+		for i, cell := range cells {
+			cells[i] = strings.Replace(cell, "|", `\|`, -1)
+		}
+		if _, err := fmt.Fprintf(w, "| %s |\n", strings.Join(cells, " | ")); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func row(columns []*Column, a *common.Account) []string {
+	cells := make([]string, 0, len(columns))
+	for _, c := range columns {
+		cells = append(cells, Text(c.Value(a)))
+	}
+
+	return cells
+}
+
+type jsonFormat struct{ valueAsJSON }
+
+// Write writes each account as an object with the columns as keys, in order,
+// and tags as an object.
+func (jsonFormat) Write(w io.Writer, columns []*Column, al []*common.Account) error {
+	var b bytes.Buffer
+	b.WriteString("[")
+	for i, a := range al {
+		if i != 0 {
+			b.WriteString(",")
+		}
+		b.WriteString("{")
+		for j, c := range columns {
+			if j != 0 {
+				b.WriteString(",")
+			}
+			key, _ := json.Marshal(c.Name)
+			value, err := json.Marshal(structured(c.Value(a)))
+			if err != nil {
+				return err
+			}
+			b.Write(key)
+			b.WriteString(":")
+			b.Write(value)
+		}
+		b.WriteString("}")
+	}
+	b.WriteString("]")
+
+	var out bytes.Buffer
+	if err := json.Indent(&out, b.Bytes(), "", "    "); err != nil {
+		return err
+	}
+	out.WriteString("\n")
+
+	_, err := out.WriteTo(w)
+	return err
+}
+
+type yamlFormat struct{}
+
+// Write writes each account as a mapping with the columns as keys, in order,
+// and tags as a mapping.
+func (yamlFormat) Write(w io.Writer, columns []*Column, al []*common.Account) error {
+	rows := make([]yaml.MapSlice, 0, len(al))
+	for _, a := range al {
+		var m yaml.MapSlice
+		for _, c := range columns {
+			v := structured(c.Value(a))
+			if tags, ok := v.(map[string]string); ok {
+				v = sortedMap(tags)
+			}
+			m = append(m, yaml.MapItem{Key: c.Name, Value: v})
+		}
+		rows = append(rows, m)
+	}
+
+	return yamlFormat{}.WriteValue(w, rows)
+}
+
+func (yamlFormat) WriteValue(w io.Writer, v interface{}) error {
+	data, err := yaml.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(data)
+	return err
+}
+
+// structured returns a value of a column in the shape written to JSON and
+// YAML: tags as a map of keys to values, times as RFC 3339 text, empty when
+// zero, and every other value as is.
+func structured(v interface{}) interface{} {
+	switch v := v.(type) {
+	case []*common.Tag:
+		m := make(map[string]string, len(v))
+		for _, t := range v {
+			m[t.Key] = t.Value
+		}
+		return m
+	case time.Time:
+		return Text(v)
+	case []string:
+		if v == nil {
+			return []string{}
+		}
+	}
+
+	return v
+}
+
+func sortedMap(m map[string]string) yaml.MapSlice {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	s := make(yaml.MapSlice, 0, len(keys))
+	for _, k := range keys {
+		s = append(s, yaml.MapItem{Key: k, Value: m[k]})
+	}
+
+	return s
+}
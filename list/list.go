@@ -0,0 +1,365 @@
+// Package list prints the accounts in the state, filtered, sorted and in a
+// choice of formats.
+package list
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jmespath/go-jmespath"
+
+	"github.com/logston/aws-aliased-profiles/common"
+)
+
+type Options struct {
+	// Only list the accounts of these organizations in the settings file,
+	// "" for the one fetched with a profile and role on the command line.
+	Orgs []string
+
+	// Only list accounts with every one of these effective tags, each given
+	// as "key" or "key=value".
+	Tags []string
+
+	// Only list accounts with one of these statuses, e.g. ACTIVE.
+	Statuses []string
+
+	// Only list accounts with an alias, and whose alias matches AliasGlob.
+	HasAlias  bool
+	AliasGlob string
+
+	// Only list accounts beneath one of these roots or organizational
+	// units, given by name or ID.
+	OUs []string
+
+	// A JMESPath expression evaluated against the accounts left by the other
+	// filters, in the shape of the state file. When it yields accounts, they
+	// are listed as usual, and otherwise its result is printed as is.
+	Query string
+
+	// The columns to print, DefaultColumns when empty.
+	Columns []string
+
+	// The columns to sort by, each descending when prefixed with "-".
+	// Accounts are sorted by ID when empty.
+	Sort []string
+
+	// One of the Formats.
+	Format string
+}
+
+// DefaultColumns are the columns printed unless others are chosen.
+var DefaultColumns = []string{"id", "alias", "name", "status", "ou"}
+
+// Column is a column that can be printed for each account.
+type Column struct {
+	Name        string
+	Description string
+	Value       func(a *common.Account) interface{}
+}
+
+// Columns are the columns that can be printed, in addition to "tag:<key>"
+// for the value of the effective tag with the given key.
+var Columns = []*Column{
+	{"id", "the account ID", func(a *common.Account) interface{} { return a.Id }},
+	{"alias", "the account alias", func(a *common.Account) interface{} { return a.Alias }},
+	{"name", "the account name", func(a *common.Account) interface{} { return a.Name }},
+	{"email", "the email address of the account", func(a *common.Account) interface{} { return a.Email }},
+	{"status", "the status of the account, e.g. ACTIVE", func(a *common.Account) interface{} { return a.Status }},
+	{"arn", "the ARN of the account", func(a *common.Account) interface{} { return a.Arn }},
+	{"joined", "when the account joined the organization", func(a *common.Account) interface{} { return a.JoinedTimestamp }},
+	{"profile", "the profile name of the account", func(a *common.Account) interface{} { return a.ProfileName() }},
+	{"org", "the name of the organization in the settings file", func(a *common.Account) interface{} { return orgName(a) }},
+	{"org-id", "the ID of the organization", func(a *common.Account) interface{} { return orgId(a) }},
+	{"ou", "the names of the organizational units of the account", func(a *common.Account) interface{} { return a.OUPath() }},
+	{"ou-id", "the IDs of the organizational units of the account", func(a *common.Account) interface{} { return a.OUIdPath() }},
+	{"tags", "the effective tags of the account", func(a *common.Account) interface{} { return a.EffectiveTags() }},
+	{"roles", "the roles discovered in the account", func(a *common.Account) interface{} { return a.Roles }},
+}
+
+func orgName(a *common.Account) string {
+	if a.Org == nil {
+		return ""
+	}
+
+	return a.Org.Name
+}
+
+func orgId(a *common.Account) string {
+	if a.Org == nil {
+		return ""
+	}
+
+	return a.Org.Id
+}
+
+// GetColumn returns the column with the given name.
+func GetColumn(name string) (*Column, error) {
+	if strings.HasPrefix(name, "tag:") {
+		key := strings.TrimPrefix(name, "tag:")
+		return &Column{
+			Name:  name,
+			Value: func(a *common.Account) interface{} { return a.EffectiveTag(key) },
+		}, nil
+	}
+
+	for _, c := range Columns {
+		if c.Name == name {
+			return c, nil
+		}
+	}
+
+	var names []string
+	for _, c := range Columns {
+		names = append(names, c.Name)
+	}
+
+	return nil, fmt.Errorf("Unknown column %q, expected one of %s or tag:<key>", name, strings.Join(names, ", "))
+}
+
+// Text returns a value of a column as text.
+func Text(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case []string:
+		return strings.Join(v, ",")
+	case []*common.Tag:
+		pairs := make([]string, 0, len(v))
+		for _, t := range v {
+			pairs = append(pairs, t.Key+"="+t.Value)
+		}
+		return strings.Join(pairs, ",")
+	case time.Time:
+		if v.IsZero() {
+			return ""
+		}
+		return v.UTC().Format(time.RFC3339)
+	}
+
+	return fmt.Sprint(v)
+}
+
+// List prints the accounts in the state of every organization, with the
+// overrides file applied, to w as chosen by opts.
+func List(w io.Writer, opts Options) (err error) {
+	// Allow e.g. --columns id,alias as well as repeating the flag.
+	opts.Columns = splitList(opts.Columns)
+	opts.Sort = splitList(opts.Sort)
+	if len(opts.Columns) == 0 {
+		opts.Columns = DefaultColumns
+	}
+
+	columns, err := getColumns(opts.Columns)
+	if err != nil {
+		return
+	}
+	sortColumns, err := getColumns(trimSigns(opts.Sort))
+	if err != nil {
+		return
+	}
+	format, err := getFormat(opts.Format)
+	if err != nil {
+		return
+	}
+
+	al, _ := common.ReadAccountList()
+	if al, err = Filter(al, opts); err != nil {
+		return
+	}
+
+	if opts.Query != "" {
+		var result interface{}
+		var ok bool
+		if al, result, ok, err = Query(al, opts.Query); err != nil {
+			return
+		}
+		if !ok {
+			return format.WriteValue(w, result)
+		}
+	}
+
+	Sort(al, sortColumns, opts.Sort)
+
+	return format.Write(w, columns, al)
+}
+
+func splitList(values []string) (split []string) {
+	for _, v := range values {
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				split = append(split, s)
+			}
+		}
+	}
+
+	return
+}
+
+func getColumns(names []string) (columns []*Column, err error) {
+	for _, name := range names {
+		var c *Column
+		if c, err = GetColumn(name); err != nil {
+			return
+		}
+		columns = append(columns, c)
+	}
+
+	return
+}
+
+func trimSigns(names []string) []string {
+	trimmed := make([]string, 0, len(names))
+	for _, name := range names {
+		trimmed = append(trimmed, strings.TrimPrefix(name, "-"))
+	}
+
+	return trimmed
+}
+
+// Filter returns the accounts that pass every filter of opts other than
+// Query.
+func Filter(al []*common.Account, opts Options) (filtered []*common.Account, err error) {
+	if opts.AliasGlob != "" {
+		if _, err = path.Match(opts.AliasGlob, ""); err != nil {
+			return nil, fmt.Errorf("Bad alias glob %q: %v", opts.AliasGlob, err)
+		}
+	}
+
+	for _, a := range al {
+		if matches(a, opts) {
+			filtered = append(filtered, a)
+		}
+	}
+
+	return
+}
+
+func matches(a *common.Account, opts Options) bool {
+	if len(opts.Orgs) != 0 && !contains(opts.Orgs, orgName(a), false) {
+		return false
+	}
+
+	if len(opts.Statuses) != 0 && !contains(opts.Statuses, a.Status, true) {
+		return false
+	}
+
+	if (opts.HasAlias || opts.AliasGlob != "") && a.Alias == "" {
+		return false
+	}
+
+	if opts.AliasGlob != "" {
+		if ok, _ := path.Match(opts.AliasGlob, a.Alias); !ok {
+			return false
+		}
+	}
+
+	if len(opts.OUs) != 0 {
+		in := false
+		for _, ou := range opts.OUs {
+			in = in || a.InOU(ou)
+		}
+		if !in {
+			return false
+		}
+	}
+
+	for _, tag := range opts.Tags {
+		kv := strings.SplitN(tag, "=", 2)
+		if len(kv) == 1 {
+			if !hasTagKey(a, kv[0]) {
+				return false
+			}
+		} else if !a.HasEffectiveTagKeyValue(kv[0], kv[1]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func contains(values []string, s string, fold bool) bool {
+	for _, v := range values {
+		if v == s || (fold && strings.EqualFold(v, s)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func hasTagKey(a *common.Account, key string) bool {
+	for _, t := range a.EffectiveTags() {
+		if t.Key == key {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Query evaluates the JMESPath expression against the accounts in the shape
+// of the state file. When the result is a list of accounts, e.g. for
+// "[?Status=='ACTIVE']", they are returned and ok is true. Otherwise, e.g. for
+// "[].Alias", the result itself is returned.
+func Query(al []*common.Account, expression string) (selected []*common.Account, result interface{}, ok bool, err error) {
+	data, err := json.Marshal(al)
+	if err != nil {
+		return
+	}
+	var doc interface{}
+	if err = json.Unmarshal(data, &doc); err != nil {
+		return
+	}
+
+	if result, err = jmespath.Search(expression, doc); err != nil {
+		return nil, nil, false, fmt.Errorf("Bad query %q: %v", expression, err)
+	}
+
+	items, isList := result.([]interface{})
+	if !isList {
+		return nil, result, false, nil
+	}
+
+	byId := make(map[string]*common.Account, len(al))
+	for _, a := range al {
+		byId[a.Id] = a
+	}
+
+	selected = []*common.Account{}
+	for _, item := range items {
+		m, _ := item.(map[string]interface{})
+		id, _ := m["Id"].(string)
+		a, found := byId[id]
+		if !found {
+			return nil, result, false, nil
+		}
+		selected = append(selected, a)
+	}
+
+	return selected, nil, true, nil
+}
+
+// Sort sorts the accounts by the text of each of the columns in turn, each
+// descending when the matching name in names is prefixed with "-", and then
+// by ID.
+func Sort(al []*common.Account, columns []*Column, names []string) {
+	sort.SliceStable(al, func(i, j int) bool {
+		for k, c := range columns {
+			vi, vj := Text(c.Value(al[i])), Text(c.Value(al[j]))
+			if vi == vj {
+				continue
+			}
+			if strings.HasPrefix(names[k], "-") {
+				return vi > vj
+			}
+			return vi < vj
+		}
+
+		return al[i].Id < al[j].Id
+	})
+}
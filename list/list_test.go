@@ -0,0 +1,417 @@
+package list
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/logston/aws-aliased-profiles/common"
+)
+
+var (
+	root      = &common.OrganizationalUnit{Id: "r-ab12", Name: "Root"}
+	workloads = &common.OrganizationalUnit{Id: "ou-ab12-11111111", Name: "Workloads", Tags: tags("env=prod")}
+	sandbox   = &common.OrganizationalUnit{Id: "ou-ab12-22222222", Name: "Sandbox", Tags: tags("env=dev")}
+)
+
+func tags(pairs ...string) (tags []*common.Tag) {
+	for _, p := range pairs {
+		kv := strings.SplitN(p, "=", 2)
+		tags = append(tags, &common.Tag{Key: kv[0], Value: kv[1]})
+	}
+
+	return
+}
+
+// accounts returns a small organization. 444444444444 overrides the env tag
+// it inherits from Workloads.
+func accounts() []*common.Account {
+	return []*common.Account{
+		{Id: "333333333333", Name: "Legacy", Status: "SUSPENDED", OUs: []*common.OrganizationalUnit{root}, Tags: tags("team=ops")},
+		{Id: "111111111111", Alias: "data-prod", Name: "Data Prod", Status: "ACTIVE", OUs: []*common.OrganizationalUnit{root, workloads}, Tags: tags("team=data")},
+		{Id: "444444444444", Alias: "web-prod", Name: "Web", Status: "ACTIVE", OUs: []*common.OrganizationalUnit{root, workloads}, Tags: tags("env=staging", "team=web")},
+		{Id: "222222222222", Alias: "data-dev", Name: "Data Dev", Status: "ACTIVE", OUs: []*common.OrganizationalUnit{root, sandbox}, Tags: tags("team=data")},
+	}
+}
+
+// ids returns the IDs of the accounts, in order.
+func ids(al []*common.Account) []string {
+	ids := make([]string, 0, len(al))
+	for _, a := range al {
+		ids = append(ids, a.Id)
+	}
+
+	return ids
+}
+
+// columns returns the columns with the given names.
+func columns(t *testing.T, names ...string) []*Column {
+	t.Helper()
+
+	columns, err := getColumns(names)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return columns
+}
+
+func TestFilter(t *testing.T) {
+	tests := []struct {
+		name string
+		opts Options
+		want []string
+		err  string
+	}{
+		{
+			name: "no filters",
+			want: []string{"333333333333", "111111111111", "444444444444", "222222222222"},
+		},
+		{
+			name: "status in any case",
+			opts: Options{Statuses: []string{"suspended"}},
+			want: []string{"333333333333"},
+		},
+		{
+			name: "any of several statuses",
+			opts: Options{Statuses: []string{"SUSPENDED", "PENDING_CLOSURE"}},
+			want: []string{"333333333333"},
+		},
+		{
+			name: "ou by name",
+			opts: Options{OUs: []string{"Workloads"}},
+			want: []string{"111111111111", "444444444444"},
+		},
+		{
+			name: "ou by id",
+			opts: Options{OUs: []string{"ou-ab12-22222222", "ou-ab12-99999999"}},
+			want: []string{"222222222222"},
+		},
+		{
+			name: "inherited tag",
+			opts: Options{Tags: []string{"env=prod"}},
+			want: []string{"111111111111"},
+		},
+		{
+			name: "tag key",
+			opts: Options{Tags: []string{"env"}},
+			want: []string{"111111111111", "444444444444", "222222222222"},
+		},
+		{
+			name: "every tag",
+			opts: Options{Tags: []string{"team=data", "env=dev"}},
+			want: []string{"222222222222"},
+		},
+		{
+			name: "has alias",
+			opts: Options{HasAlias: true},
+			want: []string{"111111111111", "444444444444", "222222222222"},
+		},
+		{
+			name: "alias glob",
+			opts: Options{AliasGlob: "data-*"},
+			want: []string{"111111111111", "222222222222"},
+		},
+		{
+			name: "every filter",
+			opts: Options{Statuses: []string{"ACTIVE"}, OUs: []string{"Workloads"}, AliasGlob: "*-prod", Tags: []string{"team"}},
+			want: []string{"111111111111", "444444444444"},
+		},
+		{
+			name: "bad alias glob",
+			opts: Options{AliasGlob: "data-["},
+			err:  `Bad alias glob "data-["`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filtered, err := Filter(accounts(), tt.opts)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("Filter returned %v, want an error containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := ids(filtered); strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("Filter returned %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQuery(t *testing.T) {
+	tests := []struct {
+		name       string
+		expression string
+
+		// The accounts selected, when the result is a list of accounts.
+		want []string
+
+		// The result otherwise.
+		result interface{}
+
+		err string
+	}{
+		{
+			name:       "accounts",
+			expression: "[?Status=='ACTIVE' && length(Tags) > `1`]",
+			want:       []string{"444444444444"},
+		},
+		{
+			name:       "no accounts",
+			expression: "[?Status=='CLOSED']",
+			want:       []string{},
+		},
+		{
+			name:       "list of values",
+			expression: "[?Alias != ''].Alias",
+			result:     []interface{}{"data-prod", "web-prod", "data-dev"},
+		},
+		{
+			name:       "single value",
+			expression: "length(@)",
+			result:     float64(4),
+		},
+		{
+			name:       "bad query",
+			expression: "[?Status==",
+			err:        "Bad query",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			selected, result, ok, err := Query(accounts(), tt.expression)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("Query returned %v, want an error containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.want != nil {
+				if !ok {
+					t.Fatalf("Query returned %v, want accounts %v", result, tt.want)
+				}
+				if got := ids(selected); strings.Join(got, ",") != strings.Join(tt.want, ",") {
+					t.Errorf("Query returned %v, want %v", got, tt.want)
+				}
+				return
+			}
+
+			if ok {
+				t.Fatalf("Query returned accounts %v, want %v", ids(selected), tt.result)
+			}
+			if !reflect.DeepEqual(result, tt.result) {
+				t.Errorf("Query returned %#v, want %#v", result, tt.result)
+			}
+		})
+	}
+}
+
+func TestSort(t *testing.T) {
+	tests := []struct {
+		name string
+		sort []string
+		want []string
+	}{
+		{
+			name: "by id",
+			want: []string{"111111111111", "222222222222", "333333333333", "444444444444"},
+		},
+		{
+			name: "ascending and descending",
+			sort: []string{"status,-alias"},
+			want: []string{"444444444444", "111111111111", "222222222222", "333333333333"},
+		},
+		{
+			name: "several columns, repeated",
+			sort: []string{"-tag:team", "ou"},
+			want: []string{"444444444444", "333333333333", "222222222222", "111111111111"},
+		},
+		{
+			name: "effective tag",
+			sort: []string{"tag:env"},
+			want: []string{"333333333333", "222222222222", "111111111111", "444444444444"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			names := splitList(tt.sort)
+			al := accounts()
+			Sort(al, columns(t, trimSigns(names)...), names)
+
+			if got := ids(al); strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("Sort returned %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetColumn(t *testing.T) {
+	tests := []struct {
+		name string
+		want []string
+		err  string
+	}{
+		{name: "ou", want: []string{"Root", "Root/Workloads", "Root/Workloads", "Root/Sandbox"}},
+		{name: "tags", want: []string{"team=ops", "env=prod,team=data", "env=staging,team=web", "env=dev,team=data"}},
+		{name: "tag:env", want: []string{"", "prod", "staging", "dev"}},
+		{name: "tag:missing", want: []string{"", "", "", ""}},
+		{name: "owner", err: `Unknown column "owner"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := GetColumn(tt.name)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("GetColumn returned %v, want an error containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for _, a := range accounts() {
+				got = append(got, Text(c.Value(a)))
+			}
+			if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+				t.Errorf("%s has values %q, want %q", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormats(t *testing.T) {
+	al := accounts()[:2]
+	al[1].Roles = []string{"Admin", "team/ReadOnly"}
+
+	tests := []struct {
+		format string
+		want   string
+
+		// The result of "[].Id".
+		value string
+	}{
+		{
+			format: "table",
+			want: `ID            ALIAS      TAG:ENV  ROLES                TAGS
+333333333333                                           team=ops
+111111111111  data-prod  prod     Admin,team/ReadOnly  env=prod,team=data
+`,
+			value: "[\n    \"333333333333\",\n    \"111111111111\"\n]\n",
+		},
+		{
+			format: "csv",
+			want: `id,alias,tag:env,roles,tags
+333333333333,,,,team=ops
+111111111111,data-prod,prod,"Admin,team/ReadOnly","env=prod,team=data"
+`,
+			value: "[\n    \"333333333333\",\n    \"111111111111\"\n]\n",
+		},
+		{
+			format: "json",
+			want: `[
+    {
+        "id": "333333333333",
+        "alias": "",
+        "tag:env": "",
+        "roles": [],
+        "tags": {
+            "team": "ops"
+        }
+    },
+    {
+        "id": "111111111111",
+        "alias": "data-prod",
+        "tag:env": "prod",
+        "roles": [
+            "Admin",
+            "team/ReadOnly"
+        ],
+        "tags": {
+            "env": "prod",
+            "team": "data"
+        }
+    }
+]
+`,
+			value: "[\n    \"333333333333\",\n    \"111111111111\"\n]\n",
+		},
+		{
+			format: "yaml",
+			want: `- id: "333333333333"
+  alias: ""
+  tag:env: ""
+  roles: []
+  tags:
+    team: ops
+- id: "111111111111"
+  alias: data-prod
+  tag:env: prod
+  roles:
+  - Admin
+  - team/ReadOnly
+  tags:
+    env: prod
+    team: data
+`,
+			value: "- \"333333333333\"\n- \"111111111111\"\n",
+		},
+		{
+			format: "markdown",
+			want: `| id | alias | tag:env | roles | tags |
+| --- | --- | --- | --- | --- |
+| 333333333333 |  |  |  | team=ops |
+| 111111111111 | data-prod | prod | Admin,team/ReadOnly | env=prod,team=data |
+`,
+			value: "[\n    \"333333333333\",\n    \"111111111111\"\n]\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			format, err := getFormat(tt.format)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var b bytes.Buffer
+			if err := format.Write(&b, columns(t, "id", "alias", "tag:env", "roles", "tags"), al); err != nil {
+				t.Fatal(err)
+			}
+			if got := b.String(); got != tt.want {
+				t.Errorf("Write wrote\n%s\nwant\n%s", got, tt.want)
+			}
+
+			_, result, _, err := Query(al, "[].Id")
+			if err != nil {
+				t.Fatal(err)
+			}
+			b.Reset()
+			if err := format.WriteValue(&b, result); err != nil {
+				t.Fatal(err)
+			}
+			if got := b.String(); got != tt.value {
+				t.Errorf("WriteValue wrote\n%s\nwant\n%s", got, tt.value)
+			}
+		})
+	}
+
+	if _, err := getFormat("xml"); err == nil || !strings.Contains(err.Error(), `Unknown format "xml"`) {
+		t.Errorf("getFormat returned %v, want an error for an unknown format", err)
+	}
+}
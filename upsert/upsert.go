@@ -14,7 +14,16 @@ import (
 func AWSConfig() {
 	t := GetProfileTemplate()
 
-	al := common.ReadAccountList()
+	al, unmatched := common.ReadAccountList()
+
+	for _, id := range unmatched {
+		fmt.Printf("Warning: the override for %s in %s matches no account\n", id, common.GetAPPath(common.OverridesFilename))
+	}
+
+	for _, a := range common.DropCollidingNameSlugs(al) {
+		fmt.Printf("Warning: leaving out profile %s for account %s, which has no alias, as another account in %s has the same profile name; set an alias for it in %s\n",
+			a.Org.ProfilePrefix+a.NameSlug(), a.Id, a.Org.Label(), common.GetAPPath(common.OverridesFilename))
+	}
 
 	profiles := GetProfileBuffer(t, al)
 
@@ -25,18 +34,30 @@ func AWSConfig() {
 	WriteAWSConfig(config)
 }
 
-func GetProfileTemplate() *template.Template {
-	path := common.GetAPPath(common.ConfigFilename)
+// TemplateFuncs are the functions available to the profile template in
+// addition to the fields and methods of common.Account.
+var TemplateFuncs = template.FuncMap{
+	"slugify":  common.Slugify,
+	"roleName": common.RoleName,
+}
 
-	t, err := template.New(common.ConfigFilename).ParseFiles(path)
+func GetProfileTemplate() *template.Template {
+	t, err := ReadProfileTemplate()
 	if err != nil {
-		fmt.Printf("Looks like there is no template at '%s'\nPlease run 'aws-aliased-profiles init' to get started.", path)
+		fmt.Printf("Looks like there is no template at '%s'\nPlease run 'aws-aliased-profiles init' to get started.", common.GetAPPath(common.ConfigFilename))
 		os.Exit(1)
 	}
 
 	return t
 }
 
+// ReadProfileTemplate parses the profile template.
+func ReadProfileTemplate() (*template.Template, error) {
+	path := common.GetAPPath(common.ConfigFilename)
+
+	return template.New(common.ConfigFilename).Funcs(TemplateFuncs).ParseFiles(path)
+}
+
 func GetProfileBuffer(t *template.Template, al []*common.Account) string {
 	var b bytes.Buffer
 
@@ -68,7 +89,7 @@ func ReadAWSConfig() string {
 func WriteAWSConfig(config string) {
 	path := common.GetAWSPath(common.AWSConfigFilename)
 
-	err := ioutil.WriteFile(path, []byte(config), 0644)
+	err := common.WriteFileAtomic(path, []byte(config), 0644)
 	if err != nil {
 		common.ExitWithError(err)
 	}
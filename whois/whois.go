@@ -0,0 +1,263 @@
+// Package whois looks up accounts in the state by ID, alias, name, profile
+// name or ARN, without calling AWS.
+package whois
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/logston/aws-aliased-profiles/common"
+	"github.com/logston/aws-aliased-profiles/upsert"
+)
+
+// Result holds the accounts matching a query.
+type Result struct {
+	Query   string
+	Matches []*Match
+}
+
+// Match is everything known about an account matching a query.
+type Match struct {
+	Id     string
+	Alias  string
+	Name   string
+	Email  string
+	Status string
+	Arn    string
+
+	// The name of the organization in the settings file, and its ID.
+	Org            string
+	OrganizationId string
+
+	// The names and IDs of the organizational units of the account, from
+	// the root down, e.g. "Root/Workloads/Prod".
+	OU    string
+	OUIds string
+
+	// The effective tags of the account, including those inherited from its
+	// organizational units.
+	Tags map[string]string
+
+	Roles []string
+
+	// The profiles the template generates for the account.
+	Profiles []string
+}
+
+var (
+	accountIdPattern   = regexp.MustCompile(`\b[0-9]{12}\b`)
+	profileNamePattern = regexp.MustCompile(`(?m)^\s*\[profile\s+([^\]]+?)\s*\]`)
+)
+
+// Lookup returns the accounts matching the query: an account ID, an ARN
+// containing one, or an alias, account name or profile name, ignoring case.
+// An empty query matches no account.
+func Lookup(al []*common.Account, query string) (matches []*common.Account) {
+	query = strings.TrimSpace(query)
+	if query == "" {
+		return nil
+	}
+
+	id := query
+	if strings.HasPrefix(query, "arn:") {
+		id = ArnAccountId(query)
+	}
+
+	for _, a := range al {
+		if common.IsAccountId(id) {
+			if a.Id == id {
+				matches = append(matches, a)
+			}
+			continue
+		}
+
+		if strings.EqualFold(a.Alias, query) ||
+			strings.EqualFold(a.Name, query) ||
+			strings.EqualFold(a.ProfileName(), query) {
+			matches = append(matches, a)
+		}
+	}
+
+	return
+}
+
+// ArnAccountId returns the ID of the account an ARN belongs to, or an empty
+// string if it has none. The ARN of an account in an organization, e.g.
+// arn:aws:organizations::111111111111:account/o-a1b2c3d4e5/222222222222,
+// belongs to the account at its end rather than the management account.
+func ArnAccountId(arn string) string {
+	parts := strings.SplitN(arn, ":", 6)
+	if len(parts) != 6 {
+		return ""
+	}
+
+	if parts[2] == "organizations" && strings.HasPrefix(parts[5], "account/") {
+		return parts[5][strings.LastIndex(parts[5], "/")+1:]
+	}
+
+	if common.IsAccountId(parts[4]) {
+		return parts[4]
+	}
+
+	// e.g. arn:aws:iam::aws:policy/... has no account, but an S3 bucket
+	// ARN may name one in the bucket.
+	return accountIdPattern.FindString(parts[5])
+}
+
+// Describe returns everything known about the account, with the profiles
+// generated for it by t, if not nil.
+func Describe(a *common.Account, t *template.Template) (m *Match, err error) {
+	m = &Match{
+		Id:     a.Id,
+		Alias:  a.Alias,
+		Name:   a.Name,
+		Email:  a.Email,
+		Status: a.Status,
+		Arn:    a.Arn,
+		OU:     a.OUPath(),
+		OUIds:  a.OUIdPath(),
+		Tags:   make(map[string]string),
+		Roles:  a.Roles,
+	}
+	if a.Org != nil {
+		m.Org = a.Org.Name
+		m.OrganizationId = a.Org.Id
+	}
+	for _, t := range a.EffectiveTags() {
+		m.Tags[t.Key] = t.Value
+	}
+
+	if t != nil {
+		var b bytes.Buffer
+		if err = t.Execute(&b, a); err != nil {
+			return
+		}
+		for _, sm := range profileNamePattern.FindAllStringSubmatch(b.String(), -1) {
+			m.Profiles = append(m.Profiles, sm[1])
+		}
+	}
+
+	return
+}
+
+// Whois looks up each query in the state of every organization, with the
+// overrides file applied, and prints the matching accounts to w, as JSON when
+// asJSON is set. Empty queries are skipped. It returns the queries that
+// matched no account.
+func Whois(w io.Writer, queries []string, asJSON bool) (unmatched []string, err error) {
+	al, _ := common.ReadAccountList()
+
+	// Profiles are only listed when there is a template to generate them.
+	t, _ := upsert.ReadProfileTemplate()
+
+	results := make([]*Result, 0, len(queries))
+	for _, q := range queries {
+		if strings.TrimSpace(q) == "" {
+			continue
+		}
+
+		r := &Result{Query: q, Matches: []*Match{}}
+		for _, a := range Lookup(al, q) {
+			var m *Match
+			if m, err = Describe(a, t); err != nil {
+				return
+			}
+			r.Matches = append(r.Matches, m)
+		}
+		if len(r.Matches) == 0 {
+			unmatched = append(unmatched, q)
+		}
+		results = append(results, r)
+	}
+
+	if asJSON {
+		var data []byte
+		if data, err = json.MarshalIndent(results, "", "    "); err != nil {
+			return
+		}
+		_, err = fmt.Fprintln(w, string(data))
+		return
+	}
+
+	for i, r := range results {
+		if i != 0 {
+			fmt.Fprintln(w)
+		}
+		Print(w, r)
+	}
+
+	return
+}
+
+// Print writes the accounts matching a query for people to read.
+func Print(w io.Writer, r *Result) {
+	if len(r.Matches) == 0 {
+		fmt.Fprintf(w, "%s: no matching account\n", r.Query)
+		return
+	}
+
+	for i, m := range r.Matches {
+		if i != 0 {
+			fmt.Fprintln(w)
+		}
+
+		fmt.Fprintln(w, m.Id)
+		field(w, "Alias", m.Alias)
+		field(w, "Name", m.Name)
+		field(w, "Email", m.Email)
+		field(w, "Status", m.Status)
+		field(w, "ARN", m.Arn)
+		if m.Org != "" && m.OrganizationId != "" {
+			field(w, "Org", fmt.Sprintf("%s (%s)", m.Org, m.OrganizationId))
+		} else {
+			field(w, "Org", m.Org+m.OrganizationId)
+		}
+		if m.OU != "" {
+			field(w, "OU", fmt.Sprintf("%s (%s)", m.OU, m.OUIds))
+		}
+
+		var tags []string
+		for _, t := range sortedTags(m.Tags) {
+			tags = append(tags, t.Key+"="+t.Value)
+		}
+		field(w, "Tags", strings.Join(tags, ", "))
+		field(w, "Roles", strings.Join(m.Roles, ", "))
+		field(w, "Profiles", strings.Join(m.Profiles, ", "))
+	}
+}
+
+// field writes a field of an account unless it is empty.
+func field(w io.Writer, name, value string) {
+	if value != "" {
+		fmt.Fprintf(w, "  %-9s %s\n", name+":", value)
+	}
+}
+
+func sortedTags(m map[string]string) []*common.Tag {
+	tags := make([]*common.Tag, 0, len(m))
+	for k, v := range m {
+		tags = append(tags, &common.Tag{Key: k, Value: v})
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i].Key < tags[j].Key })
+
+	return tags
+}
+
+// ReadQueries returns the non-empty lines of r, e.g. piped to stdin.
+func ReadQueries(r io.Reader) (queries []string, err error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if q := strings.TrimSpace(scanner.Text()); q != "" {
+			queries = append(queries, q)
+		}
+	}
+
+	return queries, scanner.Err()
+}
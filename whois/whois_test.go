@@ -0,0 +1,98 @@
+package whois
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/logston/aws-aliased-profiles/common"
+)
+
+func TestArnAccountId(t *testing.T) {
+	tests := []struct {
+		name string
+		arn  string
+		want string
+	}{
+		{
+			name: "account in an organization",
+			arn:  "arn:aws:organizations::111111111111:account/o-a1b2c3d4e5/222222222222",
+			want: "222222222222",
+		},
+		{
+			name: "role",
+			arn:  "arn:aws:iam::333333333333:role/team/ReadOnly",
+			want: "333333333333",
+		},
+		{
+			name: "role in another partition",
+			arn:  "arn:aws-us-gov:iam::333333333333:role/ReadOnly",
+			want: "333333333333",
+		},
+		{
+			name: "aws managed policy",
+			arn:  "arn:aws:iam::aws:policy/ReadOnlyAccess",
+			want: "",
+		},
+		{
+			name: "s3 bucket named after an account",
+			arn:  "arn:aws:s3:::logs-444444444444-us-east-1",
+			want: "444444444444",
+		},
+		{
+			name: "s3 bucket",
+			arn:  "arn:aws:s3:::logs",
+			want: "",
+		},
+		{
+			name: "not an arn",
+			arn:  "arn:aws:iam",
+			want: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ArnAccountId(tt.arn); got != tt.want {
+				t.Errorf("ArnAccountId(%q) = %q, want %q", tt.arn, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLookup(t *testing.T) {
+	al := []*common.Account{
+		{Id: "111111111111", Alias: "data-prod", Name: "Data Production"},
+		{Id: "222222222222", Name: "Data Dev"},
+		{Id: "333333333333", Alias: "web", Org: &common.Organization{Name: "acquired", ProfilePrefix: "acq-"}},
+		{Id: "444444444444"},
+	}
+
+	tests := []struct {
+		name  string
+		query string
+		want  []string
+	}{
+		{name: "id", query: "222222222222", want: []string{"222222222222"}},
+		{name: "arn", query: "arn:aws:iam::111111111111:role/ReadOnly", want: []string{"111111111111"}},
+		{name: "alias", query: " DATA-PROD ", want: []string{"111111111111"}},
+		{name: "name", query: "data dev", want: []string{"222222222222"}},
+		{name: "profile name", query: "Acq-Web", want: []string{"333333333333"}},
+		{name: "name slug", query: "data-dev", want: []string{"222222222222"}},
+		{name: "empty", query: "  "},
+		{name: "unknown id", query: "555555555555"},
+		{name: "arn without an account", query: "arn:aws:iam::aws:policy/ReadOnlyAccess"},
+		{name: "no match", query: "staging"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, a := range Lookup(al, tt.query) {
+				got = append(got, a.Id)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("Lookup(%q) returned %v, want %v", tt.query, got, tt.want)
+			}
+		})
+	}
+}